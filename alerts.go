@@ -0,0 +1,153 @@
+package main
+
+// Alert rules watch a channel of each fridge, announcing an alert event on
+// the fridge's stream when a reading stays past a threshold, and a resolved
+// event when it comes back.
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AlertRule raises an alert when a channel stays above or below a threshold.
+type AlertRule struct {
+	Name    string
+	Fridge  string   // the fridge (or fridge.tap) to watch, every one if empty
+	Channel string   // a channel of the samples' Readings, or fill for PubFillRatio
+	Above   *float64 // alert on readings over this
+	Below   *float64 // alert on readings under this
+	For     duration // how long readings must stay past the threshold first
+}
+
+// AlertEvent is the data of alert and resolved events.
+type AlertEvent struct {
+	Fridge    string
+	Rule      string
+	Channel   string
+	Value     float64
+	Unit      string    `json:",omitempty"`
+	Since     time.Time // when the readings first crossed the threshold
+	Timestamp time.Time
+}
+
+// alertState follows one rule for one fridge.
+type alertState struct {
+	since  time.Time // of the first reading past the threshold, zero if none
+	firing bool
+}
+
+var (
+	alertsMu sync.Mutex
+	alerts   = map[[2]string]*alertState{} // by rule name and fridge
+)
+
+// reading returns a sample's value for a channel, where fill is the fill
+// ratio unless there's a reading of that name.
+func (s Sample) reading(ch string) (float64, bool) {
+	if v, ok := s.Readings[ch]; ok {
+		return v, true
+	}
+	if ch == "fill" {
+		return clamp(s.PubFillRatio, 0.0, 1.0), true
+	}
+	return 0, false
+}
+
+// breached reports whether v is past the rule's threshold.
+func (a AlertRule) breached(v float64) bool {
+	return (a.Above != nil && v > *a.Above) || (a.Below != nil && v < *a.Below)
+}
+
+// checkAlerts runs the stable samples of a report just accepted through
+// every alert rule for its fridge.
+func checkAlerts(u ICBMreport) {
+	rules := conf().Alerts
+	if len(rules) == 0 {
+		return
+	}
+	units := seriesReport(u.FridgeName).units() // including those from earlier reports
+	ss := append([]Sample(nil), u.StableSamples...)
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Timestamp.Before(ss[j].Timestamp) })
+
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	for _, a := range rules {
+		if a.Fridge != "" && a.Fridge != u.FridgeName {
+			continue
+		}
+		key := [2]string{a.Name, u.FridgeName}
+		st := alerts[key]
+		if st == nil {
+			st = &alertState{}
+			alerts[key] = st
+		}
+		for _, s := range ss {
+			v, ok := s.reading(a.Channel)
+			if !ok {
+				continue
+			}
+			ev := AlertEvent{u.FridgeName, a.Name, a.Channel, v, units[a.Channel], st.since, s.Timestamp}
+			switch {
+			case a.breached(v):
+				if st.since.IsZero() {
+					st.since, ev.Since = s.Timestamp, s.Timestamp
+				}
+				if !st.firing && s.Timestamp.Sub(st.since) >= a.For.Duration {
+					st.firing = true
+					count("alerts_raised")
+					slog.Warn("Alert", "fridge", u.FridgeName, "rule", a.Name, "channel", a.Channel, "value", v, "since", st.since)
+					publishAlert("alert", ev)
+				}
+			default:
+				if st.firing {
+					slog.Info("Alert resolved", "fridge", u.FridgeName, "rule", a.Name, "channel", a.Channel, "value", v)
+					publishAlert("resolved", ev)
+				}
+				st.since, st.firing = time.Time{}, false
+			}
+		}
+	}
+}
+
+// publishAlert announces an alert event on the fridge's stream.
+func publishAlert(typ string, ev AlertEvent) {
+	es := fridgeStream(ev.Fridge)
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.publish(typ, ev)
+}
+
+// validate checks an alert rule, calling fail for each problem.
+func (a AlertRule) validate(where string, fail func(format string, a ...any)) {
+	if a.Name == "" {
+		fail("%s: Name must not be empty", where)
+	}
+	if a.Fridge != "" && sanitize(a.Fridge) != a.Fridge {
+		fail("%s: Fridge %q must be letters, digits, '-' or '.'", where, a.Fridge)
+	}
+	if a.Channel != "fill" && !validChannel.MatchString(a.Channel) {
+		fail("%s: Channel %q should be fill or a channel name", where, a.Channel)
+	}
+	if a.Above == nil && a.Below == nil {
+		fail("%s: needs Above, Below or both", where)
+	}
+	if a.For.Duration < 0 {
+		fail("%s: For must not be negative, not %s", where, a.For)
+	}
+}
+
+// validateAlerts checks every alert rule, and that their names are unique.
+func validateAlerts(rules []AlertRule, fail func(format string, a ...any)) {
+	names := map[string]bool{}
+	for i, a := range rules {
+		where := fmt.Sprintf("Alerts[%d]", i)
+		a.validate(where, fail)
+		if names[a.Name] {
+			fail("%s: %s is listed twice", where, a.Name)
+		}
+		names[a.Name] = true
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+// Scale faults. A failing load cell shows up in the raw samples before the
+// chart turns to nonsense: readings stuck at one value (flatline), single
+// samples leaping away and back (jump), masses the scale can't weigh with a
+// keg on or off it (range), and jitter well past what a steady keg gives
+// (noise). Each is announced on the fridge's event stream as an anomaly
+// when it starts and recovered when it stops.
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Anomaly is a suspected fault in a fridge's scale.
+type Anomaly struct {
+	Fridge    string
+	Kind      string // flatline, jump, range or noise
+	Severity  string // warning or critical
+	Detail    string
+	Value     float64   // the reading, spike or noise which gave it away
+	Since     time.Time // when it started
+	Timestamp time.Time // of the latest sample showing it
+}
+
+// anomalyState follows one series' raw samples.
+type anomalyState struct {
+	last      Sample    // the latest raw sample seen
+	flatSince time.Time // when the raw readings last changed
+	tail      []Sample  // the last two raw samples, for spikes across reports
+	active    map[string]*Anomaly
+}
+
+var (
+	anomaliesMu sync.Mutex
+	anomalies   = map[string]*anomalyState{} // by series
+)
+
+// scaleRange checks each sample's RawMass lies within tare to full, give or
+// take the margin. It judges nothing unless the scale is calibrated.
+func scaleRange(u ICBMreport, margin float64, ss []Sample) (found *Anomaly, judged bool) {
+	span := u.RawMassFull - u.RawMassTare
+	if span == 0 || len(ss) == 0 {
+		return nil, false
+	}
+	slack := margin * math.Abs(float64(span))
+	lo := float64(min(u.RawMassTare, u.RawMassFull)) - slack
+	hi := float64(max(u.RawMassTare, u.RawMassFull)) + slack
+	for _, s := range ss {
+		if m := float64(s.RawMass); m < lo || m > hi {
+			return &Anomaly{Kind: "range", Severity: "critical", Value: m, Since: s.Timestamp, Timestamp: s.Timestamp,
+				Detail: fmt.Sprintf("raw mass %d is outside %.0f to %.0f", s.RawMass, lo, hi)}, true
+		}
+	}
+	return nil, true
+}
+
+// flatline follows how long the raw readings have been unchanged.
+func (st *anomalyState) flatline(raw []Sample, p AnomalyConfig) (found *Anomaly, judged bool) {
+	for _, s := range raw {
+		if st.last.Timestamp.IsZero() || s.RawMass != st.last.RawMass || s.RawFillRatio != st.last.RawFillRatio {
+			st.flatSince = s.Timestamp
+		}
+		st.last = s
+	}
+	if p.FlatlineFor.Duration <= 0 || len(raw) == 0 {
+		return nil, false
+	}
+	if stuck := st.last.Timestamp.Sub(st.flatSince); stuck >= p.FlatlineFor.Duration {
+		return &Anomaly{Kind: "flatline", Severity: "critical", Value: float64(st.last.RawMass), Since: st.flatSince, Timestamp: st.last.Timestamp,
+			Detail: fmt.Sprintf("raw readings unchanged for %s", stuck.Round(time.Second))}, true
+	}
+	return nil, true
+}
+
+// jump looks for a raw sample leaping away from both its neighbours, in the
+// same direction, by more than MaxJump.
+func (st *anomalyState) jump(raw []Sample, p AnomalyConfig) (found *Anomaly, judged bool) {
+	w := append(append([]Sample(nil), st.tail...), raw...)
+	st.tail = w[max(0, len(w)-2):]
+	if p.MaxJump <= 0 || len(raw) == 0 || len(w) < 3 {
+		return nil, false
+	}
+	for i := 1; i+1 < len(w); i++ {
+		a, b, c := w[i-1], w[i], w[i+1]
+		if c.Timestamp.Sub(a.Timestamp) > conf().Pours.MaxGap.Duration {
+			continue
+		}
+		up, back := b.RawFillRatio-a.RawFillRatio, b.RawFillRatio-c.RawFillRatio
+		if math.Abs(up) > p.MaxJump && math.Abs(back) > p.MaxJump && (up > 0) == (back > 0) {
+			found = &Anomaly{Kind: "jump", Severity: "warning", Value: up, Since: b.Timestamp, Timestamp: b.Timestamp,
+				Detail: fmt.Sprintf("raw fill ratio jumped %+.3f for one sample", up)}
+		}
+	}
+	return found, true
+}
+
+// minNoiseSamples is how many changes between raw samples it takes to judge
+// the noise.
+const minNoiseSamples = 10
+
+// noise takes the median change in raw fill ratio from one sample to the
+// next, which pours and refills barely move but a failing load cell does.
+func noise(raw []Sample, p AnomalyConfig) (found *Anomaly, judged bool) {
+	var steps []float64
+	for i := 1; i < len(raw); i++ {
+		if raw[i].Timestamp.Sub(raw[i-1].Timestamp) <= conf().Pours.MaxGap.Duration {
+			steps = append(steps, math.Abs(raw[i].RawFillRatio-raw[i-1].RawFillRatio))
+		}
+	}
+	if p.MaxNoise <= 0 || len(steps) < minNoiseSamples {
+		return nil, false
+	}
+	sort.Float64s(steps)
+	if median := steps[len(steps)/2]; median > p.MaxNoise {
+		last := raw[len(raw)-1].Timestamp
+		return &Anomaly{Kind: "noise", Severity: "warning", Value: median, Since: raw[0].Timestamp, Timestamp: last,
+			Detail: fmt.Sprintf("raw fill ratio moves %.4f a sample", median)}, true
+	}
+	return nil, true
+}
+
+// checkAnomalies runs a report just accepted through the fault checks,
+// announcing anomalies as they start and stop.
+func checkAnomalies(u ICBMreport) {
+	p := conf().Anomalies
+	raw := append([]Sample(nil), u.RawSamples...)
+	sort.Slice(raw, func(i, j int) bool { return raw[i].Timestamp.Before(raw[j].Timestamp) })
+
+	anomaliesMu.Lock()
+	defer anomaliesMu.Unlock()
+	st := anomalies[u.FridgeName]
+	if st == nil {
+		st = &anomalyState{active: map[string]*Anomaly{}}
+		anomalies[u.FridgeName] = st
+	}
+	i := sort.Search(len(raw), func(i int) bool { return raw[i].Timestamp.After(st.last.Timestamp) })
+	raw = raw[i:] // only the samples we haven't seen
+
+	type check struct {
+		found  *Anomaly
+		judged bool
+	}
+	var checks []check
+	add := func(found *Anomaly, judged bool) { checks = append(checks, check{found, judged}) }
+	add(scaleRange(u, p.Margin, append(append([]Sample(nil), raw...), u.StableSamples...)))
+	add(st.flatline(raw, p))
+	add(st.jump(raw, p))
+	add(noise(raw, p))
+
+	for i, kind := range []string{"range", "flatline", "jump", "noise"} {
+		c, was := checks[i], st.active[kind]
+		switch {
+		case c.found != nil && was == nil:
+			a := c.found
+			a.Fridge = u.FridgeName
+			st.active[kind] = a
+			count("anomalies")
+			count("anomalies_" + kind)
+			slog.Warn("Scale anomaly", "fridge", a.Fridge, "kind", kind, "severity", a.Severity, "detail", a.Detail)
+			publishAnomaly("anomaly", *a, p.Alert)
+		case c.found != nil:
+			was.Value, was.Detail, was.Timestamp = c.found.Value, c.found.Detail, c.found.Timestamp
+		case c.judged && was != nil:
+			delete(st.active, kind)
+			slog.Info("Scale anomaly over", "fridge", was.Fridge, "kind", kind)
+			publishAnomaly("recovered", *was, p.Alert)
+		}
+	}
+}
+
+// publishAnomaly announces an anomaly event on the fridge's stream, and an
+// alert event too if wanted.
+func publishAnomaly(typ string, a Anomaly, alert bool) {
+	es := fridgeStream(a.Fridge)
+	es.mu.Lock()
+	es.publish(typ, a)
+	es.mu.Unlock()
+	if !alert {
+		return
+	}
+	if typ == "recovered" {
+		typ = "resolved"
+	} else {
+		typ = "alert"
+	}
+	publishAlert(typ, AlertEvent{Fridge: a.Fridge, Rule: "anomaly-" + a.Kind, Channel: "raw", Value: a.Value, Since: a.Since, Timestamp: a.Timestamp})
+}
+
+// activeAnomalies returns the anomalies a series has now, worst first.
+func activeAnomalies(series string) []Anomaly {
+	anomaliesMu.Lock()
+	defer anomaliesMu.Unlock()
+	var all []Anomaly
+	if st := anomalies[series]; st != nil {
+		for _, a := range st.active {
+			all = append(all, *a)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Severity != all[j].Severity {
+			return all[i].Severity == "critical"
+		}
+		return all[i].Kind < all[j].Kind
+	})
+	return all
+}
+
+// validate checks the anomaly detection settings, calling fail for each problem.
+func (p AnomalyConfig) validate(fail func(format string, a ...any)) {
+	if p.FlatlineFor.Duration < 0 {
+		fail("Anomalies.FlatlineFor: must not be negative, not %s", p.FlatlineFor)
+	}
+	if p.MaxJump < 0 || p.MaxJump > 1 {
+		fail("Anomalies.MaxJump: must be between 0 and 1, not %g", p.MaxJump)
+	}
+	if p.Margin < 0 {
+		fail("Anomalies.Margin: must not be negative, not %g", p.Margin)
+	}
+	if p.MaxNoise < 0 || p.MaxNoise > 1 {
+		fail("Anomalies.MaxNoise: must be between 0 and 1, not %g", p.MaxNoise)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnomalies(t *testing.T) {
+	keepLive(t)
+	t.Cleanup(func() {
+		anomaliesMu.Lock()
+		clear(anomalies)
+		anomaliesMu.Unlock()
+	})
+	c := *conf()
+	c.Anomalies.Alert = true
+	current.Store(&c)
+	at := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	raw := func(start time.Duration, step time.Duration, fills ...float64) []Sample {
+		ss := make([]Sample, len(fills))
+		for i, f := range fills {
+			ss[i] = Sample{Timestamp: at.Add(start + time.Duration(i)*step), RawFillRatio: f, RawMass: 300000 + int(f*500000)}
+		}
+		return ss
+	}
+	steady := func(start time.Duration, n int) []Sample {
+		fills := make([]float64, n)
+		for i := range fills {
+			fills[i] = 0.5 + float64(i%2)*0.001
+		}
+		return raw(start, time.Second, fills...)
+	}
+	noisy := make([]float64, 12)
+	for i := range noisy {
+		noisy[i] = 0.5 + float64(i%2)*0.05
+	}
+	flat := make([]float64, 190)
+	for i := range flat {
+		flat[i] = 0.5
+	}
+	outside := raw(0, time.Second, 0.5, 0.5)
+	outside[1].RawMass = 1000000
+
+	for _, tc := range []struct {
+		kind, severity string
+		bad            []Sample
+	}{
+		{"range", "critical", outside},
+		{"flatline", "critical", raw(0, 10*time.Second, flat...)},
+		{"jump", "warning", raw(0, time.Second, 0.5, 0.5, 0.9, 0.5, 0.5)},
+		{"noise", "warning", raw(0, time.Second, noisy...)},
+	} {
+		fridge := "Faultville-" + tc.kind
+		ch, _ := fridgeStream(fridge).subscribe(0)
+		before := counterValue("anomalies_" + tc.kind)
+		checkAnomalies(ICBMreport{FridgeName: fridge, RawMassFull: 800000, RawMassTare: 300000, RawSamples: tc.bad})
+		got := activeAnomalies(fridge)
+		if len(got) != 1 || got[0].Kind != tc.kind || got[0].Severity != tc.severity || got[0].Fridge != fridge {
+			t.Errorf("%s: got anomalies %+v", tc.kind, got)
+		}
+		if counterValue("anomalies_"+tc.kind) != before+1 {
+			t.Errorf("%s: not counted", tc.kind)
+		}
+		checkAnomalies(ICBMreport{FridgeName: fridge, RawMassFull: 800000, RawMassTare: 300000, RawSamples: steady(time.Hour, 12)})
+		if got := activeAnomalies(fridge); len(got) != 0 {
+			t.Errorf("%s: not recovered: %+v", tc.kind, got)
+		}
+
+		var types []string
+		for range 4 {
+			ev := <-ch
+			types = append(types, ev.Type)
+			if ev.Type == "anomaly" {
+				var a Anomaly
+				if err := json.Unmarshal(ev.Data, &a); err != nil || a.Kind != tc.kind {
+					t.Errorf("%s: anomaly event %s", tc.kind, ev.Data)
+				}
+			}
+		}
+		if strings.Join(types, " ") != "anomaly alert recovered resolved" {
+			t.Errorf("%s: got events %v", tc.kind, types)
+		}
+		fridgeStream(fridge).unsubscribe(ch)
+	}
+
+	// A steady keg, calibrated or not, is fine.
+	for _, u := range []ICBMreport{
+		{FridgeName: "Faultville-ok", RawMassFull: 800000, RawMassTare: 300000, RawSamples: steady(0, 30)},
+		{FridgeName: "Faultville-ok", RawSamples: raw(time.Minute, time.Second, 0.5, 0.49, 0.48, 0.47, 0.46, 0.46, 0.46)},
+	} {
+		checkAnomalies(u)
+	}
+	if got := activeAnomalies("Faultville-ok"); len(got) != 0 {
+		t.Errorf("false alarm: %+v", got)
+	}
+
+	fridge := "Faultville-status"
+	tapReport[fridge] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: outside})
+	checkAnomalies(ICBMreport{FridgeName: fridge, RawMassFull: 800000, RawMassTare: 300000, RawSamples: outside})
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/b/" + fridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(status), "anomaly: critical range since 2024-01-02T03:00:01Z: raw mass 1000000 is outside 250000 to 850000\n") {
+		t.Errorf("/b/ doesn't show the anomaly: %s", status)
+	}
+}
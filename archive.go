@@ -7,16 +7,17 @@
 // sync by hand for setup to b2 bucket
 // Bucket contents:
 // - copies of all received reports
-// 		https://<bucket>.<endpoint>/data/<fridge>/archive/yyyymmddhhmmss.json.gz
+// 		https://<bucket>.<endpoint>/data/<fridge>/archive/yyyymmddhhmmss.nnnnnnnnn.json.gz
+// 		(yyyymmddhhmmss.json.gz before reports were named to the nanosecond)
 // - daily rollups
 // 		https://<bucket>.<endpoint>/data/<fridge>/day/yyyymmdd.json.gz
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"os"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -24,53 +25,48 @@
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-const ( // todo: move to .env and set in CI / fly
-	s3Endpoint = "https://s3.us-west-002.backblazeb2.com"
-	s3Region   = "us-west-002"
-	s3Bucket   = "lunarville-icbm"
-)
-
 type Archive struct {
 	client *s3.S3
+	bucket string
 }
 
 var (
-	s3client         *Archive
+	s3client         atomic.Pointer[Archive] // nil if not configured
 	errUninitialized = fmt.Errorf("s3 client is not yet initialized")
 )
 
-func init() {
-	var err error
-	s3client, err = NewS3Client()
-	if err != nil {
-		log.Println("Could not initialize S3 client:", err)
-	}
+// NewS3Client returns a client for the archive in the configuration.
+func NewS3Client() (ar *Archive, err error) {
+	return newArchive(conf().S3)
 }
 
-func NewS3Client() (ar *Archive, err error) {
-	key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
-	if key == "" || secret == "" {
-		err = fmt.Errorf("no S3 creds found in environment")
+// newArchive returns a client for the archive described by cfg.
+func newArchive(cfg S3Config) (ar *Archive, err error) {
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		err = fmt.Errorf("no S3 creds found in config or environment")
 		return
 	}
 	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(key, secret, ""),
-		Endpoint:         aws.String(s3Endpoint),
-		Region:           aws.String(s3Region),
+		Credentials:      credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Endpoint:         aws.String(cfg.Endpoint),
+		Region:           aws.String(cfg.Region),
 		S3ForcePathStyle: aws.Bool(true),
 	}
 	newSession, err := session.NewSession(s3Config)
 	if err != nil {
 		return
 	}
-	ar = &Archive{client: s3.New(newSession)}
+	ar = &Archive{client: s3.New(newSession), bucket: cfg.Bucket}
 	return
 }
 
 func (ar *Archive) List(prefix string) ([]string, error) {
+	if ar == nil {
+		return nil, errUninitialized
+	}
 	var keys []string
 	params := &s3.ListObjectsInput{
-		Bucket:    aws.String(s3Bucket),
+		Bucket:    aws.String(ar.bucket),
 		Prefix:    aws.String(prefix),
 		Delimiter: aws.String("/"),
 	}
@@ -83,24 +79,57 @@ func (ar *Archive) List(prefix string) ([]string, error) {
 	return keys, err
 }
 
+// ListAll returns every key under prefix, descending into "subfolders".
+func (ar *Archive) ListAll(prefix string) ([]string, error) {
+	if ar == nil {
+		return nil, errUninitialized
+	}
+	var keys []string
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(ar.bucket),
+		Prefix: aws.String(prefix),
+	}
+	err := ar.client.ListObjectsPages(params, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, key := range page.Contents {
+			keys = append(keys, *key.Key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Ping checks the bucket exists and our credentials can reach it.
+func (ar *Archive) Ping(ctx context.Context) error {
+	if ar == nil {
+		return errUninitialized
+	}
+	_, err := ar.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(ar.bucket),
+	})
+	return err
+}
+
 func (ar *Archive) Put(key string, data []byte) error {
 	if ar == nil {
 		return errUninitialized
 	}
 	_, err := ar.client.PutObject(&s3.PutObjectInput{
 		Body:   bytes.NewReader(data),
-		Bucket: aws.String(s3Bucket),
+		Bucket: aws.String(ar.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload: %s/%s: %w", s3Bucket, key, err)
+		return fmt.Errorf("failed to upload: %s/%s: %w", ar.bucket, key, err)
 	}
 	return nil
 }
 
 func (ar *Archive) Get(key string) (data []byte, err error) {
+	if ar == nil {
+		return nil, errUninitialized
+	}
 	obj, err := ar.client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s3Bucket),
+		Bucket: aws.String(ar.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
@@ -113,7 +142,7 @@ func (ar *Archive) Get(key string) (data []byte, err error) {
 
 func (ar *Archive) Delete(key string) error {
 	_, err := ar.client.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s3Bucket),
+		Bucket: aws.String(ar.bucket),
 		Key:    aws.String(key),
 	})
 	return err
@@ -0,0 +1,273 @@
+package main
+
+// The beverage catalog: what's on tap in each fridge (or each of its taps),
+// kept in the series' data folder as beverage.json. Admins set it through
+// /admin/beverages/{fridge}, and a refill closes out the keg, moving it to
+// the history.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Beverage describes a keg, or a fridge's worth of cans.
+type Beverage struct {
+	Name     string
+	Brewery  string    `json:",omitempty"`
+	Style    string    `json:",omitempty"`
+	ABV      float64   `json:",omitempty"` // percent alcohol by volume
+	KegSize  float64   `json:",omitempty"` // litres
+	Tapped   time.Time // when it went on, defaults to when it was set
+	Finished time.Time `json:",omitzero"`  // when it was closed out
+	Image    string    `json:",omitempty"` // URL of a picture of it
+}
+
+// Catalog is what's on in one fridge or tap, and what was on before.
+type Catalog struct {
+	Current *Beverage  `json:",omitempty"`
+	History []Beverage // oldest first
+}
+
+// catalogFile is the name of the catalog in each series' data folder.
+const catalogFile = "beverage.json"
+
+var (
+	catalogsMu sync.Mutex
+	catalogs   = map[string]*Catalog{} // by file name, read from disk as needed
+)
+
+// catalog returns the catalog of a series, reading it if needed. Only
+// catalogs on disk are cached, so asking after any number of fridges which
+// don't exist doesn't fill memory. Requires catalogsMu.
+func catalog(series string) (*Catalog, error) {
+	fn := filepath.Join(dataRoot, series, catalogFile)
+	if c := catalogs[fn]; c != nil {
+		return c, nil
+	}
+	c := &Catalog{History: []Beverage{}}
+	b, err := os.ReadFile(fn)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return c, nil
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("%s: %w", catalogFile, err)
+		}
+	}
+	catalogs[fn] = c
+	return c, nil
+}
+
+// saveCatalog writes the catalog of a series, replacing the old file whole,
+// and caches it. Requires catalogsMu.
+func saveCatalog(series string, c *Catalog) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(dataRoot, series)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, catalogFile)
+	tmp, err := os.CreateTemp(dir, "icbm-catalog-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fn); err != nil {
+		return err
+	}
+	catalogs[fn] = c
+	return nil
+}
+
+// onTap returns what's on in a series, or nil if nobody has said.
+func onTap(series string) *Beverage {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	c, err := catalog(series)
+	if err != nil || c.Current == nil {
+		return nil
+	}
+	b := *c.Current
+	return &b
+}
+
+// closeOutKeg moves what's on in a series to its history, as finished at t.
+// It's called when a refill is seen. A keg tapped at t or later is left on:
+// an admin often records the new keg before the report of the refill
+// arrives.
+func closeOutKeg(series string, t time.Time) {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	c, err := catalog(series)
+	if err != nil {
+		slog.Error("Couldn't read the beverage catalog", "fridge", series, "err", err)
+		return
+	}
+	if c.Current == nil || !c.Current.Tapped.Before(t) {
+		return
+	}
+	done := *c.Current
+	done.Finished = t
+	updated := Catalog{History: append(append([]Beverage(nil), c.History...), done)}
+	if err := saveCatalog(series, &updated); err != nil {
+		slog.Error("Couldn't archive the finished keg", "fridge", series, "err", err)
+		return
+	}
+	slog.Info("Keg finished", "fridge", series, "beverage", done.Name)
+}
+
+// validate checks a beverage from an admin.
+func (b Beverage) validate() error {
+	var errs []error
+	if strings.TrimSpace(b.Name) == "" {
+		errs = append(errs, errors.New("Name must not be empty"))
+	}
+	if b.ABV < 0 || b.ABV > 100 {
+		errs = append(errs, fmt.Errorf("ABV is a percentage, not %g", b.ABV))
+	}
+	if b.KegSize < 0 {
+		errs = append(errs, fmt.Errorf("KegSize must not be negative, not %g", b.KegSize))
+	}
+	if b.Image != "" && !validImage(b.Image) {
+		errs = append(errs, fmt.Errorf("Image %q should be an http(s) URL or a path on this server", b.Image))
+	}
+	return errors.Join(errs...)
+}
+
+// validImage reports whether s is an absolute http(s) URL or a path on this
+// server. A path starting // or /\ would be another host to a browser.
+func validImage(s string) bool {
+	u, err := url.Parse(s)
+	switch {
+	case err != nil:
+		return false
+	case u.Scheme == "http" || u.Scheme == "https":
+		return u.Host != ""
+	default:
+		return u.Scheme == "" && strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.Contains(s, `\`)
+	}
+}
+
+// beverages answers GET /beverages/{fridge} with the fridge's catalog, empty
+// for a known fridge which hasn't had one set.
+func beverages(w http.ResponseWriter, r *http.Request) {
+	series := strings.Trim(r.URL.Path, "/")
+	if series == "" || sanitize(series) != series {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+	catalogsMu.Lock()
+	c, err := catalog(series)
+	// Only catalogs on disk are cached.
+	found := knownFridge(series) || catalogs[filepath.Join(dataRoot, series, catalogFile)] != nil
+	var b []byte
+	if err == nil {
+		b, err = json.Marshal(c)
+	}
+	catalogsMu.Unlock()
+	if err == nil && !found {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		ctxLog(r.Context()).Error("Couldn't read the beverage catalog", "fridge", series, "err", err)
+		http.Error(w, "Couldn't read the catalog", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// adminBeverages handles /admin/beverages/{fridge}: PUT a Beverage to say
+// what's now on, archiving anything still on, or DELETE to close out the
+// current keg by hand.
+func adminBeverages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Please PUT a beverage, or DELETE to close out the keg", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	series := strings.Trim(r.URL.Path, "/")
+	if series == "" || sanitize(series) != series {
+		http.Error(w, "Please name a fridge of letters, digits, '-' or '.'", http.StatusBadRequest)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+
+	var bev Beverage
+	if r.Method == http.MethodPut {
+		body, err := readBody(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &bev); err != nil {
+			http.Error(w, "Couldn't decode the beverage: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := bev.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if bev.Tapped.IsZero() {
+			bev.Tapped = time.Now().UTC().Truncate(time.Second)
+		}
+		bev.Finished = time.Time{}
+	}
+
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	c, err := catalog(series)
+	if err != nil {
+		ctxLog(r.Context()).Error("Couldn't read the beverage catalog", "fridge", series, "err", err)
+		http.Error(w, "Couldn't read the catalog", http.StatusInternalServerError)
+		return
+	}
+	updated := Catalog{Current: c.Current, History: append([]Beverage(nil), c.History...)}
+	if updated.Current != nil {
+		done := *updated.Current
+		done.Finished = time.Now().UTC().Truncate(time.Second)
+		if r.Method == http.MethodPut && bev.Tapped.Before(done.Finished) {
+			done.Finished = bev.Tapped
+		}
+		updated.History = append(updated.History, done)
+		updated.Current = nil
+	}
+	if r.Method == http.MethodPut {
+		updated.Current = &bev
+	}
+	if err := saveCatalog(series, &updated); err != nil {
+		ctxLog(r.Context()).Error("Couldn't save the beverage catalog", "fridge", series, "err", err)
+		http.Error(w, "Couldn't save the catalog", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
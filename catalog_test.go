@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	freshData(t)
+	fridge := "Catalogville"
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	do := func(method, path, key, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Icbm-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	stout := `{"Name": "Oatmeal Stout", "Brewery": "Lunar Brewing", "Style": "Stout", "ABV": 5.8, "KegSize": 19.5, "Tapped": "2024-01-02T00:00:00Z"}`
+	for _, tc := range []struct {
+		method, key, body string
+		code              int
+	}{
+		{"PUT", "", stout, http.StatusUnauthorized},
+		{"PUT", "user", stout, http.StatusForbidden},
+		{"POST", "admin", stout, http.StatusMethodNotAllowed},
+		{"PUT", "admin", `{"ABV": 120}`, http.StatusBadRequest},
+		{"PUT", "admin", `{"Name": "x", "Image": "javascript:alert(1)"}`, http.StatusBadRequest},
+		{"PUT", "admin", `{"Name": "x", "Image": "//elsewhere.example/x.png"}`, http.StatusBadRequest},
+		{"PUT", "admin", `{"Name": "x", "Image": "https:x.png"}`, http.StatusBadRequest},
+		{"PUT", "admin", stout, http.StatusOK},
+	} {
+		if code, body := do(tc.method, "/admin/beverages/"+fridge, tc.key, tc.body); code != tc.code {
+			t.Errorf("%s %s with key %q: got %d, expected %d: %s", tc.method, tc.body, tc.key, code, tc.code, body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataRoot, fridge, catalogFile)); err != nil {
+		t.Error("catalog not stored:", err)
+	}
+
+	var cat Catalog
+	code, body := do("GET", "/beverages/"+fridge, "", "")
+	if err := json.Unmarshal([]byte(body), &cat); code != http.StatusOK || err != nil || cat.Current == nil || cat.Current.Name != "Oatmeal Stout" {
+		t.Fatalf("catalog: %d %v %s", code, err, body)
+	}
+
+	at := time.Now().UTC()
+	tapReport[fridge] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: []Sample{{PubFillRatio: 0.1, Timestamp: at}}})
+	if page := renderPage(FridgeConfig{Name: fridge, Template: "Lunarville.tmpl"}, fridge); !strings.Contains(page, "Oatmeal Stout, Lunar Brewing, Stout, 5.8% ABV") || !strings.Contains(page, `fetch("/beverages/`+fridge+`")`) {
+		t.Errorf("glass page doesn't show the beverage: %s", page)
+	}
+
+	// A refill finishes the keg.
+	update := func(ss ...Sample) {
+		if err := processUpdate(t.Context(), ICBMreport{FridgeName: fridge, StableSamples: ss}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(Sample{PubFillRatio: 0.1, Timestamp: at})
+	update(Sample{PubFillRatio: 0.95, Timestamp: at.Add(time.Minute)})
+	_, body = do("GET", "/beverages/"+fridge, "", "")
+	cat = Catalog{}
+	json.Unmarshal([]byte(body), &cat)
+	if cat.Current != nil || len(cat.History) != 1 || !cat.History[0].Finished.Equal(at.Add(time.Minute)) {
+		t.Errorf("refill didn't archive the keg: %s", body)
+	}
+
+	// The new keg is often recorded before the report of the refill arrives.
+	// That refill is the keg going on, so it stays on.
+	porter := fmt.Sprintf(`{"Name": "Porter", "Tapped": %q}`, at.Add(3*time.Minute).Format(time.RFC3339))
+	if code, body := do("PUT", "/admin/beverages/"+fridge, "admin", porter); code != http.StatusOK {
+		t.Fatalf("put: %d %s", code, body)
+	}
+	update(Sample{PubFillRatio: 0.1, Timestamp: at.Add(2 * time.Minute)}, Sample{PubFillRatio: 0.95, Timestamp: at.Add(150 * time.Second)})
+	if b := onTap(fridge); b == nil || b.Name != "Porter" {
+		t.Errorf("the refill before the keg was tapped closed it out: %+v", b)
+	}
+
+	// Putting on a new one, then closing it out by hand.
+	do("PUT", "/admin/beverages/"+fridge, "admin", `{"Name": "Pale Ale"}`)
+	if code, body := do("DELETE", "/admin/beverages/"+fridge, "admin", ""); code != http.StatusOK || !strings.Contains(body, "Pale Ale") {
+		t.Errorf("delete: %d %s", code, body)
+	}
+	if onTap(fridge) != nil {
+		t.Error("keg still on after being closed out")
+	}
+
+	// A known fridge without a catalog has an empty one. Asking after
+	// fridges which don't exist is a 404, and doesn't fill the cache.
+	if code, body := do("GET", "/beverages/"+conf().Fridges[0].Name, "", ""); code != http.StatusOK || body != "{\"History\":[]}\n" {
+		t.Errorf("fridge without a catalog: %d %s", code, body)
+	}
+	catalogsMu.Lock()
+	cached := len(catalogs)
+	catalogsMu.Unlock()
+	for i := range 10 {
+		if code, body := do("GET", fmt.Sprintf("/beverages/nosuchfridge%d", i), "", ""); code != http.StatusNotFound {
+			t.Errorf("unknown fridge: expected 404, got %d %s", code, body)
+		}
+	}
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	if len(catalogs) != cached {
+		t.Errorf("catalogs of unknown fridges were cached: %d, expected %d", len(catalogs), cached)
+	}
+}
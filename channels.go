@@ -0,0 +1,221 @@
+package main
+
+// Sensors besides the scale. Samples may carry Readings by channel name, such
+// as the fridge's temperature or whether the door is open, with the report
+// naming each channel's unit. Readings are stored with the samples, charted
+// in data/{fridge}/{channel}.tsv, and listed on /channels/{fridge}.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// validChannel matches the channel names we accept, which are also used as
+// file names.
+var validChannel = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,31}$`)
+
+// dropBadChannels removes readings with unusable names or values from every
+// sample of the report, and units for channels with unusable names,
+// reporting whether there were any.
+func dropBadChannels(ctx context.Context, r *ICBMreport) bool {
+	dropped := map[string]bool{}
+	clean := func(ss []Sample) {
+		for _, s := range ss {
+			for ch, v := range s.Readings {
+				if !validChannel.MatchString(ch) || math.IsNaN(v) || math.IsInf(v, 0) {
+					delete(s.Readings, ch)
+					dropped[ch] = true
+				}
+			}
+		}
+	}
+	units := func(u map[string]string) {
+		for ch := range u {
+			if !validChannel.MatchString(ch) {
+				delete(u, ch)
+				dropped[ch] = true
+			}
+		}
+	}
+	clean(r.RawSamples)
+	clean(r.StableSamples)
+	units(r.Units)
+	for _, t := range r.Taps {
+		clean(t.RawSamples)
+		clean(t.StableSamples)
+		units(t.Units)
+	}
+	if len(dropped) > 0 {
+		countN("bad_readings", len(dropped))
+		ctxLog(ctx).Warn("Dropped readings with bad channel names or values", "fridge", r.FridgeName, "channels", sortedKeys(dropped))
+	}
+	return len(dropped) > 0
+}
+
+// chartChannels appends the report's stable readings to each channel's chart
+// file.
+func chartChannels(u ICBMreport) error {
+	charts := map[string]*strings.Builder{}
+	for _, s := range u.StableSamples {
+		for ch, v := range s.Readings {
+			if charts[ch] == nil {
+				charts[ch] = &strings.Builder{}
+			}
+			fmt.Fprintf(charts[ch], "%d\t%g\n", s.Timestamp.Unix(), v)
+		}
+	}
+	for ch, b := range charts {
+		if err := appendChart(dataPath(u.FridgeName, ch+".tsv"), b.String()); err != nil {
+			return fmt.Errorf("%s: %w", ch, err)
+		}
+	}
+	return nil
+}
+
+// appendChart adds lines to a chart file, keeping the last ChartLines.
+func appendChart(filename, lines string) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open data file for appending: %w", err)
+	}
+	if _, err := f.Write([]byte(lines)); err != nil {
+		f.Close()
+		return fmt.Errorf("could not append chartdata: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close written file: %w", err)
+	}
+	return trimFile(filename, conf().ChartLines)
+}
+
+// ChannelSummary describes one of a fridge's channels over the samples in
+// memory.
+type ChannelSummary struct {
+	Name           string
+	Unit           string    `json:",omitempty"`
+	Value          float64   // the latest reading
+	Timestamp      time.Time // of the latest reading
+	Min, Max, Mean float64
+	Chart          string // path of the channel's chart data
+}
+
+// ChannelPoint is one reading of a channel.
+type ChannelPoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// channelPoints returns the stable readings of a channel since a time, oldest
+// first, and the channel's unit.
+func channelPoints(r *ICBMreport, ch string, since time.Time) (ps []ChannelPoint, unit string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sort()
+	for _, s := range r.StableSamples {
+		if v, ok := s.Readings[ch]; ok && !s.Timestamp.Before(since) {
+			ps = append(ps, ChannelPoint{s.Timestamp, v})
+		}
+	}
+	return ps, r.Units[ch]
+}
+
+// units returns a copy of the units of a report's channels.
+func (r *ICBMreport) units() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.Units)
+}
+
+// channelNames returns the channels with stable readings in a report, sorted.
+func channelNames(r *ICBMreport) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := map[string]bool{}
+	for _, s := range r.StableSamples {
+		for ch := range s.Readings {
+			names[ch] = true
+		}
+	}
+	return sortedKeys(names)
+}
+
+// channelSummaries summarizes every channel of a series since a time.
+func channelSummaries(series string, since time.Time) []ChannelSummary {
+	r := seriesReport(series)
+	if r == nil {
+		return nil
+	}
+	cs := []ChannelSummary{}
+	for _, ch := range channelNames(r) {
+		ps, unit := channelPoints(r, ch, since)
+		if len(ps) == 0 {
+			continue
+		}
+		c := ChannelSummary{Name: ch, Unit: unit, Min: math.Inf(1), Max: math.Inf(-1), Chart: "/data/" + series + "/" + ch + ".tsv"}
+		for _, p := range ps {
+			c.Min, c.Max = math.Min(c.Min, p.Value), math.Max(c.Max, p.Value)
+			c.Mean += p.Value / float64(len(ps))
+		}
+		last := ps[len(ps)-1]
+		c.Value, c.Timestamp = last.Value, last.Timestamp
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// fridgeChannels answers /channels/{fridge} with a summary of each channel,
+// and /channels/{fridge}/{channel} with its readings, both as JSON. The
+// optional since parameter limits them to a recent duration, eg ?since=24h.
+func fridgeChannels(w http.ResponseWriter, r *http.Request) {
+	series, ch, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	rep := seriesReport(series)
+	if rep == nil {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+	since, err := sinceParam(r, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var res any = channelSummaries(series, since)
+	if ch != "" {
+		if !slices.Contains(channelNames(rep), ch) {
+			http.NotFound(w, r)
+			return
+		}
+		ps, unit := channelPoints(rep, ch, since)
+		if ps == nil {
+			ps = []ChannelPoint{}
+		}
+		res = struct {
+			Fridge, Channel string
+			Unit            string `json:",omitempty"`
+			Readings        []ChannelPoint
+		}{series, ch, unit, ps}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// sortedKeys returns the keys of a set, sorted.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChannels(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Limits.KeyPerMinute, c.Limits.IPPerMinute = 0, 0
+	current.Store(&c)
+	apikey := randhex(32)
+	users.Store(&map[string]User{apikey: {Username: "testbot", Valid: true}})
+
+	at := time.Now().UTC().Truncate(time.Second)
+	rep := ICBMreport{
+		FridgeName: "Sensorville",
+		Units:      map[string]string{"temperature": "°C", "door": "open", "bad/name": "x"},
+		StableSamples: []Sample{
+			{PubFillRatio: 0.5, Timestamp: at.Add(-time.Hour), Readings: map[string]float64{"temperature": 3, "door": 0, "bad/name": 1}},
+			{PubFillRatio: 0.5, Timestamp: at, Readings: map[string]float64{"temperature": 5}},
+		},
+	}
+	body, _ := json.Marshal(rep)
+	r := httptest.NewRequest("POST", "/icbm/v1", strings.NewReader(string(body)))
+	r.Header.Set("X-Icbm-Api-Key", apikey)
+	w := httptest.NewRecorder()
+	icbmUpdate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+
+	stored, err := readReport(mustGlob(t, filepath.Join(dataRoot, "Sensorville", "*.json.gz")))
+	if err != nil || stored.StableSamples[1].Readings["temperature"] != 5 || stored.Units["temperature"] != "°C" {
+		t.Errorf("readings not stored: %v %+v", err, stored)
+	}
+	if _, found := stored.StableSamples[0].Readings["bad/name"]; found {
+		t.Error("a reading with a bad channel name was stored")
+	}
+	if b, err := os.ReadFile(filepath.Join(dataRoot, "Sensorville", "temperature.tsv")); err != nil || strings.Count(string(b), "\n") != 2 {
+		t.Errorf("temperature chart: %v %q", err, b)
+	}
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	get := func(path string, v any) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK {
+			if err := json.Unmarshal(b, v); err != nil {
+				t.Errorf("%s: %s %s", path, err, b)
+			}
+		}
+		return resp.StatusCode
+	}
+	var cs []ChannelSummary
+	if code := get("/channels/Sensorville", &cs); code != http.StatusOK || len(cs) != 2 {
+		t.Fatalf("channels: %d %+v", code, cs)
+	}
+	if temp := cs[1]; temp.Name != "temperature" || temp.Unit != "°C" || temp.Value != 5 || temp.Min != 3 || temp.Mean != 4 {
+		t.Errorf("unexpected temperature summary %+v", temp)
+	}
+	var series struct{ Readings []ChannelPoint }
+	if code := get("/channels/Sensorville/temperature?since=30m", &series); code != http.StatusOK || len(series.Readings) != 1 || series.Readings[0].Value != 5 {
+		t.Errorf("recent temperatures: %d %+v", code, series)
+	}
+	if code := get("/channels/Sensorville/humidity", nil); code != http.StatusNotFound {
+		t.Errorf("unknown channel: expected 404, got %d", code)
+	}
+	if code := get("/channels/Sensorville?since=yesterday", nil); code != http.StatusBadRequest {
+		t.Errorf("bad since: expected 400, got %d", code)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	keepLive(t)
+	c := *conf()
+	warm := 6.0
+	c.Alerts = []AlertRule{{Name: "warm", Fridge: "Alertville", Channel: "temperature", Above: &warm, For: duration{10 * time.Minute}}}
+	current.Store(&c)
+	fridge := "Alertville"
+	tapReport[fridge] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, Units: map[string]string{"temperature": "°C"}})
+
+	ch, _ := fridgeStream(fridge).subscribe(0)
+	defer fridgeStream(fridge).unsubscribe(ch)
+	at := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	temps := func(start time.Duration, vv ...float64) ICBMreport {
+		u := ICBMreport{FridgeName: fridge}
+		for i, v := range vv {
+			u.StableSamples = append(u.StableSamples, Sample{Timestamp: at.Add(start + time.Duration(i)*5*time.Minute), Readings: map[string]float64{"temperature": v}})
+		}
+		return u
+	}
+
+	checkAlerts(temps(0, 4, 7, 8)) // warm for only five minutes
+	select {
+	case ev := <-ch:
+		t.Fatalf("alerted too soon: %s %s", ev.Type, ev.Data)
+	default:
+	}
+	checkAlerts(temps(15*time.Minute, 9, 5))
+	var got []string
+	for range 2 {
+		ev := <-ch
+		got = append(got, ev.Type+" "+string(ev.Data))
+	}
+	want := []string{
+		`alert {"Fridge":"Alertville","Rule":"warm","Channel":"temperature","Value":9,"Unit":"°C","Since":"2024-01-02T03:05:00Z","Timestamp":"2024-01-02T03:15:00Z"}`,
+		`resolved {"Fridge":"Alertville","Rule":"warm","Channel":"temperature","Value":5,"Unit":"°C","Since":"2024-01-02T03:05:00Z","Timestamp":"2024-01-02T03:20:00Z"}`,
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+}
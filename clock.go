@@ -0,0 +1,213 @@
+package main
+
+// Fridge clocks. The Pi in the fridge has no real-time clock, so after a
+// power cut it can report from 2018 until NTP catches up. Each report's
+// latest sample is compared with when the report arrived; the offset is kept
+// in clock.jsonl in the fridge's data folder. Reports can arrive late, so
+// only a clock which is clearly wrong, ahead of the server, further behind
+// than Clock.MaxBehind or from before this server was built, has its
+// timestamps shifted to match, with Clock.Correct set, and is stored with a
+// ClockFix saying so.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockFix notes how a stored report's timestamps were corrected.
+type ClockFix struct {
+	Offset   duration // added to every timestamp
+	Received time.Time
+}
+
+// ClockReading is one measurement of a fridge's clock.
+type ClockReading struct {
+	Time      time.Time // when the report arrived
+	Offset    duration  // arrival less the latest sample's time, positive if the fridge is behind
+	Corrected bool      `json:",omitempty"`
+}
+
+// clockFile is the name of the clock log in each fridge's data folder.
+const clockFile = "clock.jsonl"
+
+// A reading is logged if the offset has moved by more than clockJitter
+// since the last logged, or clockEvery has passed.
+const (
+	clockJitter = time.Minute
+	clockEvery  = time.Hour
+)
+
+// saneEpoch is a year before this server's source was committed, or the
+// start of 2025 if that's unknown. A report from earlier comes from a clock
+// which hasn't been set.
+var saneEpoch = func() time.Time {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if t, err := time.Parse(time.RFC3339, s.Value); s.Key == "vcs.time" && err == nil {
+				return t.AddDate(-1, 0, 0)
+			}
+		}
+	}
+	return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+}()
+
+// clockState is the latest and last logged readings of a fridge's clock.
+type clockState struct {
+	latest, logged ClockReading
+}
+
+var (
+	clocksMu sync.Mutex
+	clocks   = map[string]*clockState{} // by fridge
+)
+
+// latestSample returns the time of the newest sample in a report, zero if
+// there are none.
+func latestSample(r ICBMreport) time.Time {
+	var latest time.Time
+	check := func(ss []Sample) {
+		for _, s := range ss {
+			if s.Timestamp.After(latest) {
+				latest = s.Timestamp
+			}
+		}
+	}
+	check(r.RawSamples)
+	check(r.StableSamples)
+	for _, t := range r.Taps {
+		check(t.RawSamples)
+		check(t.StableSamples)
+	}
+	return latest
+}
+
+// shifted returns a copy of ss with d added to each timestamp.
+func shifted(ss []Sample, d time.Duration) []Sample {
+	out := make([]Sample, len(ss))
+	for i, s := range ss {
+		s.Timestamp = s.Timestamp.Add(d)
+		out[i] = s
+	}
+	return out
+}
+
+// checkClock measures a report's clock offset and records it. With
+// Clock.Correct set, it shifts the timestamps of a report whose clock is
+// clearly wrong: its latest sample is more than Clock.MaxSkew ahead of when
+// it arrived, more than Clock.MaxBehind behind, or before saneEpoch. A report
+// which is merely late, having waited in an MQTT buffer or for a retry, is
+// left alone. It reports whether it shifted them.
+func checkClock(ctx context.Context, r *ICBMreport, received time.Time) bool {
+	r.ClockFix = nil // only we get to say
+	latest := latestSample(*r)
+	if latest.IsZero() {
+		return false
+	}
+	c := conf().Clock
+	off := received.Sub(latest)
+	skewed := off.Abs() > c.MaxSkew.Duration
+	behind := c.MaxBehind.Duration > 0 && off > c.MaxBehind.Duration
+	wrong := off < -c.MaxSkew.Duration || behind || latest.Before(saneEpoch)
+	reading := ClockReading{Time: received.UTC(), Offset: duration{off.Round(time.Second)}, Corrected: wrong && c.Correct}
+	if skewed {
+		count("clock_skewed_reports")
+		ctxLog(ctx).Warn("Fridge clock is off", "fridge", r.FridgeName, "offset", reading.Offset, "corrected", reading.Corrected)
+	}
+	if reading.Corrected {
+		count("clock_corrections")
+		r.RawSamples, r.StableSamples = shifted(r.RawSamples, off), shifted(r.StableSamples, off)
+		if len(r.Taps) > 0 {
+			taps := make([]TapReport, len(r.Taps))
+			for i, t := range r.Taps {
+				t.RawSamples, t.StableSamples = shifted(t.RawSamples, off), shifted(t.StableSamples, off)
+				taps[i] = t
+			}
+			r.Taps = taps
+		}
+		r.ClockFix = &ClockFix{Offset: duration{off}, Received: received.UTC()}
+	}
+	if err := recordClock(r.FridgeName, reading); err != nil {
+		ctxLog(ctx).Error("Couldn't record the clock offset", "fridge", r.FridgeName, "err", err)
+	}
+	return reading.Corrected
+}
+
+// recordClock notes a fridge's latest clock reading, logging it if it's
+// news.
+func recordClock(fridge string, reading ClockReading) error {
+	clocksMu.Lock()
+	defer clocksMu.Unlock()
+	st := clocks[fridge]
+	if st == nil {
+		st = &clockState{}
+		clocks[fridge] = st
+	}
+	st.latest = reading
+	last := st.logged
+	if !last.Time.IsZero() && (reading.Offset.Duration-last.Offset.Duration).Abs() <= clockJitter &&
+		reading.Time.Sub(last.Time) < clockEvery && reading.Corrected == last.Corrected {
+		return nil
+	}
+	st.logged = reading
+	return appendJSONLine(dataPath(fridge, clockFile), reading)
+}
+
+// latestClock returns a fridge's latest clock reading, if there's been one.
+func latestClock(fridge string) (ClockReading, bool) {
+	clocksMu.Lock()
+	defer clocksMu.Unlock()
+	if st := clocks[fridge]; st != nil {
+		return st.latest, true
+	}
+	return ClockReading{}, false
+}
+
+// ClockReport is a fridge's clock offset and its history.
+type ClockReport struct {
+	Fridge  string
+	MaxSkew duration
+	Latest  *ClockReading `json:",omitempty"`
+	Skewed  bool
+	History []ClockReading
+}
+
+// fridgeClock answers /clock/{fridge} with the fridge's clock offset and the
+// logged offsets of the last week, or of the duration given by ?since=, as
+// JSON.
+func fridgeClock(w http.ResponseWriter, r *http.Request) {
+	fridge := strings.Trim(r.URL.Path, "/")
+	if !knownFridge(fridge) {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = fridge
+	since, err := sinceParam(r, 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all, err := readJSONLines[ClockReading](filepath.Join(dataRoot, fridge, clockFile))
+	if err != nil {
+		ctxLog(r.Context()).Error("Couldn't read the clock log", "fridge", fridge, "err", err)
+		http.Error(w, "Couldn't read the clock log", http.StatusInternalServerError)
+		return
+	}
+	rep := ClockReport{Fridge: fridge, MaxSkew: conf().Clock.MaxSkew, History: []ClockReading{}}
+	for _, c := range all {
+		if !c.Time.Before(since) {
+			rep.History = append(rep.History, c)
+		}
+	}
+	if c, ok := latestClock(fridge); ok {
+		rep.Latest = &c
+		rep.Skewed = c.Offset.Abs() > rep.MaxSkew.Duration
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Clock.Correct = true
+	current.Store(&c)
+	fridge := "Clockville"
+
+	// Straight after boot the fridge thinks it's 2018.
+	old := time.Date(2018, 9, 13, 5, 11, 32, 0, time.UTC)
+	rep := ICBMreport{FridgeName: fridge, StableSamples: []Sample{{Timestamp: old.Add(-time.Minute), PubFillRatio: 0.5}, {Timestamp: old, PubFillRatio: 0.5}}}
+	if err := acceptReport(t.Context(), rep, nil); err != nil {
+		t.Fatal(err)
+	}
+	fn := mustGlob(t, filepath.Join(dataRoot, fridge, "*.json.gz"))
+	stored, err := readReport(fn)
+	os.Remove(fn)
+	if err != nil || stored.ClockFix == nil || stored.ClockFix.Offset.Duration < 8*365*24*time.Hour {
+		t.Fatalf("corrected report not flagged: %v %+v", err, stored)
+	}
+	if d := time.Since(stored.StableSamples[1].Timestamp); d < 0 || d > time.Minute || stored.StableSamples[1].Timestamp.Sub(stored.StableSamples[0].Timestamp) != time.Minute {
+		t.Errorf("timestamps not shifted: %+v", stored.StableSamples)
+	}
+	if rep.StableSamples[1].Timestamp != old {
+		t.Error("the report sent was changed")
+	}
+
+	// Then NTP catches up. A fridge can't claim its report was corrected.
+	now := time.Now().UTC().Add(10 * time.Minute).Truncate(time.Second)
+	rep = ICBMreport{FridgeName: fridge, StableSamples: []Sample{{Timestamp: now.Add(-5 * time.Second), PubFillRatio: 0.5}}, ClockFix: &ClockFix{}}
+	if err := acceptReport(t.Context(), rep, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = readReport(mustGlob(t, filepath.Join(dataRoot, fridge, "*.json.gz")))
+	if err != nil || stored.ClockFix != nil {
+		t.Errorf("good report flagged: %v %+v", err, stored)
+	}
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	var cr ClockReport
+	code, body := get("/clock/" + fridge)
+	if err := json.Unmarshal([]byte(body), &cr); code != http.StatusOK || err != nil {
+		t.Fatalf("clock: %d %v %s", code, err, body)
+	}
+	if len(cr.History) != 2 || !cr.History[0].Corrected || cr.History[1].Corrected || cr.Latest == nil || cr.Skewed {
+		t.Errorf("unexpected clock report %s", body)
+	}
+	if _, err := os.Stat(filepath.Join(dataRoot, fridge, "clock.jsonl")); err != nil {
+		t.Errorf("clock log not kept with the fridge's data: %v", err)
+	}
+	if _, body := get("/b/" + fridge); !strings.Contains(body, "clock-offset: ") {
+		t.Errorf("/b/ doesn't show the clock offset: %s", body)
+	}
+	if code, _ := get("/clock/" + fridge + "?since=soon"); code != http.StatusBadRequest {
+		t.Errorf("bad since: expected 400, got %d", code)
+	}
+
+	// A report which waited an hour to be sent is skewed, but its clock is
+	// right, so it's stored as sent. One from an hour ahead, or two days
+	// behind, is corrected.
+	late := "Clockville-late"
+	for _, tc := range []struct {
+		ahead   time.Duration
+		correct bool
+	}{{-time.Hour, false}, {time.Hour, true}, {-48 * time.Hour, true}} {
+		sent := time.Now().UTC().Add(tc.ahead).Truncate(time.Second)
+		rep := ICBMreport{FridgeName: late, StableSamples: []Sample{{Timestamp: sent, PubFillRatio: 0.5}}}
+		if err := acceptReport(t.Context(), rep, nil); err != nil {
+			t.Fatal(err)
+		}
+		fn := mustGlob(t, filepath.Join(dataRoot, late, "*.json.gz"))
+		stored, err := readReport(fn)
+		os.Remove(fn)
+		if err != nil || (stored.ClockFix != nil) != tc.correct || stored.StableSamples[0].Timestamp.Equal(sent) == tc.correct {
+			t.Errorf("report %s ahead: expected corrected %v, got %v %+v", tc.ahead, tc.correct, err, stored)
+		}
+		if c, _ := latestClock(late); (c.Offset.Duration+tc.ahead).Abs() > time.Minute || c.Corrected != tc.correct {
+			t.Errorf("report %s ahead: unexpected clock reading %+v", tc.ahead, c)
+		}
+	}
+}
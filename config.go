@@ -0,0 +1,649 @@
+package main
+
+// Configuration shared by every subcommand. Settings come from the defaults
+// below, then the JSON file named by $ICBMConfig (icbm.json if unset and
+// present), then individual environment variables, in increasing priority.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds everything which differs between deployments.
+type Config struct {
+	HTTP        string // listen address for plain http
+	HTTPS       string // listen address for https, off if empty
+	TLS         TLSConfig
+	DataRoot    string   // folder holding all fridge data
+	S3          S3Config // the report archive
+	CORSOrigins []string // origins allowed to fetch /data/
+	MaxAge      duration // how much history to keep per fridge in memory
+	ChartLines  int      // samples kept in each fridge's .tsv chart file
+
+	ShutdownTimeout duration // how long to wait for requests and uploads when stopping
+
+	Templates string // folder of .tmpl files to use over the built-in ones
+	TimeZone  string // where the fridges are, for hours of the day, eg America/Los_Angeles
+	Fridges   []FridgeConfig
+
+	Log     LogConfig
+	Metrics string // listen address for Prometheus /metrics, off if empty
+	Limits  LimitConfig
+
+	StoreAsSent bool // store gzipped uploads as is, rather than recompressing them, when nothing changed
+
+	MQTT MQTTConfig
+
+	Events EventsConfig
+
+	Alerts []AlertRule
+
+	Pours PourConfig
+
+	Anomalies AnomalyConfig
+
+	Clock ClockConfig
+
+	Uptime UptimeConfig
+
+	Ledger LedgerConfig
+}
+
+// LedgerConfig sets up the restock cost ledger.
+type LedgerConfig struct {
+	Currency   string   // what amounts are in, eg USD
+	PintLitres float64  // 0.473 for US pints, 0.568 for imperial
+	LinkWindow duration // how far a purchase may be from the refill it's linked to
+}
+
+// PourConfig tunes pour detection in the raw samples.
+type PourConfig struct {
+	Noise       float64  // fill ratio wobble to ignore
+	Settle      int      // consecutive samples within Noise which make a steady level
+	MaxGap      duration // a gap in the raw samples this long starts detection afresh
+	MaxDuration duration // drops taking longer than this aren't pours
+	MinLitres   float64  // smaller drops are noise or bumps
+	MaxLitres   float64  // larger drops are the keg being moved
+	KegLitres   float64  // keg size when the beverage catalog doesn't say
+}
+
+// AnomalyConfig tunes the detection of scale faults.
+type AnomalyConfig struct {
+	FlatlineFor duration // raw readings unchanged this long mean a stuck load cell, 0 to not check
+	MaxJump     float64  // a one-sample spike in raw fill ratio this big can't be real, 0 to not check
+	Margin      float64  // how far RawMass may stray outside tare to full, as a fraction of the span
+	MaxNoise    float64  // the typical change in raw fill ratio from one sample to the next, 0 to not check
+	Alert       bool     // also announce anomalies as alert and resolved events
+}
+
+// ClockConfig sets how fridges with wrong clocks are handled.
+type ClockConfig struct {
+	MaxSkew   duration // a report whose latest sample is further than this from when it arrived is skewed
+	MaxBehind duration // a clock further behind than this is wrong, not just late; 0 for no limit
+	Correct   bool     // shift the timestamps of reports from the future, too far behind, or from before the server was built, to when they arrived
+}
+
+// UptimeConfig sets what counts as a gap in a fridge's data.
+type UptimeConfig struct {
+	Cadence   duration // how often fridges send a stable sample
+	GapFactor float64  // a stretch this many times Cadence without a sample is a gap
+}
+
+// EventsConfig tunes the live updates on /events/{fridge}.
+type EventsConfig struct {
+	Heartbeat  duration // how often idle streams get a keepalive comment
+	StaleAfter duration // a fridge silent this long is announced as stale
+	RefillJump float64  // a rise in fill ratio this big is announced as a refill, 0 for never
+
+	MaxStreams      int // open streams in all, beyond which clients are told to reload instead, 0 for no limit
+	MaxStreamsPerIP int // open streams from one address, 0 for no limit
+}
+
+// MQTTConfig describes an optional MQTT broker to take reports from.
+type MQTTConfig struct {
+	Broker   string // eg tcp://localhost:1883, off if empty
+	ClientID string // defaults to icbm-hostname
+	Username string
+	Password string
+	Flush    duration // how often buffered samples are ingested as a report
+	Topics   []MQTTTopic
+}
+
+// MQTTTopic maps messages on a topic to the user sending them.
+type MQTTTopic struct {
+	Topic  string // subscription filter, + and # wildcards allowed
+	User   string // the enabled user the messages count as coming from
+	Format string // report for ICBMreport JSON, raw or stable for one Sample per message
+	Fridge string // the fridge raw and stable samples belong to
+}
+
+// LimitConfig caps what clients may send, and how long connections may take.
+type LimitConfig struct {
+	MaxBody    int64 // bytes in one report, as sent
+	MaxDecoded int64 // bytes in one report once decompressed
+	MaxSamples int   // raw and stable samples in one report
+
+	// Token bucket rate limits for /icbm/v1, 0 for unlimited.
+	KeyPerMinute float64 // reports per API key
+	KeyBurst     int
+	IPPerMinute  float64 // requests per client address, before the API key is checked
+	IPBurst      int
+
+	ReadHeaderTimeout duration
+	ReadTimeout       duration
+	WriteTimeout      duration
+	IdleTimeout       duration
+}
+
+// LogConfig controls the server log and the access log.
+type LogConfig struct {
+	Level      string      // debug, info, warn or error
+	Format     string      // text or json
+	Access     string      // access log format: off, text or json
+	AccessFile string      // append the access log here rather than stderr
+	Filters    []LogFilter // noisy lines from the http server to count rather than log
+}
+
+// LogFilter drops http server log lines containing Match, incrementing the
+// counter named Counter instead.
+type LogFilter struct {
+	Match   string
+	Counter string
+}
+
+// S3Config describes the S3 compatible bucket reports are archived to.
+type S3Config struct {
+	Disabled        bool
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// TLSConfig describes the certificates served over https.
+type TLSConfig struct {
+	Hosts      []string   // names to answer for, and to put in a self-signed certificate
+	Certs      []CertPair // picked by SNI, reloaded when the files change
+	SelfSigned bool       // generate a certificate at startup, for local development
+	Redirect   bool       // answer plain http with a redirect to https
+}
+
+// CertPair names a PEM certificate (chain) and its private key.
+type CertPair struct {
+	Cert string
+	Key  string
+}
+
+// FridgeConfig maps a status page to the fridge and template it renders.
+type FridgeConfig struct {
+	Name     string // as sent in the report's FridgeName
+	Page     string // path the status page is served on, eg /bev
+	Template string // defaults to Name.tmpl
+}
+
+// duration is a time.Duration which reads and writes as "744h" in JSON.
+type duration struct{ time.Duration }
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"744h\": %w", err)
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// defaultConfig returns the settings used for lunarville.org.
+func defaultConfig() Config {
+	c := Config{
+		HTTP:     ":8080",
+		DataRoot: "data",
+		TLS:      TLSConfig{Redirect: true},
+		S3: S3Config{
+			Endpoint: "https://s3.us-west-002.backblazeb2.com",
+			Region:   "us-west-002",
+			Bucket:   "lunarville-icbm",
+		},
+		CORSOrigins: []string{
+			"http://lunarville.org",
+			"http://www.lunarville.org",
+			"https://lunarville.org",
+			"https://www.lunarville.org",
+			"https://api.evq.io",
+			"https://icbm.api.evq.io",
+			"http://localhost:*",
+			"https://icbm.fly.dev",
+		},
+		MaxAge:     duration{31 * 24 * time.Hour},
+		ChartLines: 10000,
+
+		ShutdownTimeout: duration{10 * time.Second},
+		Fridges: []FridgeConfig{
+			{Name: "Lunarville", Page: "/bev"},
+			{Name: "Lunarville-beta", Page: "/bevbeta"},
+		},
+
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+			Access: "off",
+			Filters: []LogFilter{
+				// Scanners and old clients, nothing we can do about them.
+				{Match: "http: TLS handshake error from", Counter: "tls_handshake_errors"},
+				// https://github.com/golang/go/issues/26918
+				{Match: "server: error reading preface from client", Counter: "preface_read_errors"},
+			},
+		},
+		Metrics: ":9091",
+		MQTT:    MQTTConfig{Flush: duration{time.Minute}},
+		Events: EventsConfig{
+			Heartbeat:  duration{15 * time.Second},
+			StaleAfter: duration{20 * time.Minute},
+			RefillJump: 0.3,
+
+			MaxStreams:      200,
+			MaxStreamsPerIP: 8,
+		},
+		Pours: PourConfig{
+			Noise:       0.003,
+			Settle:      3,
+			MaxGap:      duration{15 * time.Second},
+			MaxDuration: duration{90 * time.Second},
+			MinLitres:   0.1,
+			MaxLitres:   2,
+			KegLitres:   19.5,
+		},
+		Anomalies: AnomalyConfig{
+			FlatlineFor: duration{30 * time.Minute},
+			MaxJump:     0.25,
+			Margin:      0.1,
+			MaxNoise:    0.01,
+		},
+		Clock: ClockConfig{
+			MaxSkew:   duration{10 * time.Minute},
+			MaxBehind: duration{24 * time.Hour},
+		},
+		Uptime: UptimeConfig{
+			Cadence:   duration{time.Minute},
+			GapFactor: 3,
+		},
+		TimeZone: "UTC",
+		Ledger: LedgerConfig{
+			Currency:   "USD",
+			PintLitres: 0.473,
+			LinkWindow: duration{48 * time.Hour},
+		},
+		Limits: LimitConfig{
+			MaxBody:    1 << 20,
+			MaxDecoded: 16 << 20,
+			MaxSamples: 10000,
+
+			KeyPerMinute: 6,
+			KeyBurst:     20,
+			IPPerMinute:  30,
+			IPBurst:      60,
+
+			ReadHeaderTimeout: duration{10 * time.Second},
+			ReadTimeout:       duration{30 * time.Second},
+			WriteTimeout:      duration{60 * time.Second},
+			IdleTimeout:       duration{2 * time.Minute},
+		},
+	}
+	if superfly() {
+		c.DataRoot = "/data"
+	}
+	return c
+}
+
+// current holds the configuration in effect, replaced wholesale by reload.
+var current atomic.Pointer[Config]
+
+func init() {
+	c := defaultConfig()
+	current.Store(&c)
+}
+
+// conf returns the configuration in effect. Treat it as read-only.
+func conf() *Config {
+	return current.Load()
+}
+
+// readConfig returns the configuration from defaults, the file fn (if not
+// empty) and the environment, in that order.
+func readConfig(fn string) (Config, error) {
+	c := defaultConfig()
+	if fn != "" {
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return c, fmt.Errorf("couldn't read config: %w", err)
+		}
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("couldn't parse %s: %w", fn, err)
+		}
+	}
+	if err := c.fromEnv(); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+// fromEnv overrides settings with any environment variables which are set.
+func (c *Config) fromEnv() error {
+	str := func(dst *string, key string) {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	str(&c.HTTP, "ICBMHttp")
+	str(&c.HTTPS, "ICBMHttps")
+	if v := os.Getenv("ICBMTLSHosts"); v != "" {
+		c.TLS.Hosts = strings.Split(v, ",")
+	}
+	str(&c.DataRoot, "ICBMDataRoot")
+	str(&c.S3.Endpoint, "ICBMS3Endpoint")
+	str(&c.S3.Region, "ICBMS3Region")
+	str(&c.S3.Bucket, "ICBMS3Bucket")
+	str(&c.S3.AccessKeyID, "AWS_ACCESS_KEY_ID")
+	str(&c.S3.SecretAccessKey, "AWS_SECRET_ACCESS_KEY")
+	if v := os.Getenv("ICBMS3Disabled"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("ICBMS3Disabled: %w", err)
+		}
+		c.S3.Disabled = b
+	}
+	if v := os.Getenv("ICBMCorsOrigins"); v != "" {
+		c.CORSOrigins = strings.Split(v, ",")
+	}
+	if v := os.Getenv("ICBMMaxAge"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("ICBMMaxAge: %w", err)
+		}
+		c.MaxAge.Duration = d
+	}
+	if v := os.Getenv("ICBMShutdownTimeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("ICBMShutdownTimeout: %w", err)
+		}
+		c.ShutdownTimeout.Duration = d
+	}
+	if v := os.Getenv("ICBMChartLines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("ICBMChartLines: %w", err)
+		}
+		c.ChartLines = n
+	}
+	str(&c.Log.Level, "ICBMLogLevel")
+	str(&c.Log.Format, "ICBMLogFormat")
+	str(&c.Log.Access, "ICBMAccessLog")
+	str(&c.Log.AccessFile, "ICBMAccessLogFile")
+	str(&c.Metrics, "ICBMMetrics")
+	str(&c.MQTT.Broker, "ICBMMQTTBroker")
+	str(&c.MQTT.Username, "ICBMMQTTUsername")
+	str(&c.MQTT.Password, "ICBMMQTTPassword")
+	return nil
+}
+
+// validate returns every problem found with the configuration.
+func (c *Config) validate() error {
+	var errs []error
+	fail := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	if _, _, err := net.SplitHostPort(c.HTTP); err != nil {
+		fail("HTTP: %q is not an address:port: %w", c.HTTP, err)
+	}
+	if c.HTTPS != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPS); err != nil {
+			fail("HTTPS: %q is not an address:port: %w", c.HTTPS, err)
+		}
+		if len(c.TLS.Certs) == 0 && !c.TLS.SelfSigned {
+			fail("TLS: https needs Certs or SelfSigned")
+		}
+		for i, p := range c.TLS.Certs {
+			if p.Cert == "" || p.Key == "" {
+				fail("TLS.Certs[%d]: needs both Cert and Key", i)
+			}
+		}
+	}
+	if c.DataRoot == "" {
+		fail("DataRoot: must not be empty")
+	}
+	if !c.S3.Disabled {
+		if u, err := url.Parse(c.S3.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("S3.Endpoint: %q is not a URL", c.S3.Endpoint)
+		}
+		if c.S3.Region == "" {
+			fail("S3.Region: must not be empty")
+		}
+		if c.S3.Bucket == "" {
+			fail("S3.Bucket: must not be empty")
+		}
+	}
+	for _, o := range c.CORSOrigins {
+		if !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			fail("CORSOrigins: %q should start with http:// or https://", o)
+		}
+	}
+	if c.MaxAge.Duration <= 0 {
+		fail("MaxAge: must be positive, not %s", c.MaxAge)
+	}
+	if c.ChartLines <= 0 {
+		fail("ChartLines: must be positive, not %d", c.ChartLines)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		fail("ShutdownTimeout: must be positive, not %s", c.ShutdownTimeout)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		fail("Log.Level: %q should be debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("Log.Format: %q should be text or json", c.Log.Format)
+	}
+	if c.Log.Access != "off" && c.Log.Access != "text" && c.Log.Access != "json" {
+		fail("Log.Access: %q should be off, text or json", c.Log.Access)
+	}
+	for i, f := range c.Log.Filters {
+		if f.Match == "" {
+			fail("Log.Filters[%d]: Match must not be empty", i)
+		}
+		if f.Counter != "" && !validCounter.MatchString(f.Counter) {
+			fail("Log.Filters[%d]: counter %q must be lower case letters, digits and _", i, f.Counter)
+		}
+	}
+	if c.Metrics != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics); err != nil {
+			fail("Metrics: %q is not an address:port: %w", c.Metrics, err)
+		}
+	}
+	l := c.Limits
+	if l.MaxBody <= 0 {
+		fail("Limits.MaxBody: must be positive, not %d", l.MaxBody)
+	}
+	if l.MaxDecoded < 1<<10 {
+		fail("Limits.MaxDecoded: must be at least 1024, not %d", l.MaxDecoded)
+	}
+	if l.MaxSamples <= 0 {
+		fail("Limits.MaxSamples: must be positive, not %d", l.MaxSamples)
+	}
+	if l.KeyPerMinute < 0 || (l.KeyPerMinute > 0 && l.KeyBurst < 1) {
+		fail("Limits: KeyPerMinute must not be negative, and needs a KeyBurst of at least 1")
+	}
+	if l.IPPerMinute < 0 || (l.IPPerMinute > 0 && l.IPBurst < 1) {
+		fail("Limits: IPPerMinute must not be negative, and needs an IPBurst of at least 1")
+	}
+	for name, d := range map[string]duration{"ReadHeaderTimeout": l.ReadHeaderTimeout, "ReadTimeout": l.ReadTimeout,
+		"WriteTimeout": l.WriteTimeout, "IdleTimeout": l.IdleTimeout} {
+		if d.Duration < 0 {
+			fail("Limits.%s: must not be negative, not %s", name, d)
+		}
+	}
+	c.MQTT.validate(fail)
+	if c.Events.Heartbeat.Duration <= 0 {
+		fail("Events.Heartbeat: must be positive, not %s", c.Events.Heartbeat)
+	}
+	if c.Events.StaleAfter.Duration <= 0 {
+		fail("Events.StaleAfter: must be positive, not %s", c.Events.StaleAfter)
+	}
+	if c.Events.RefillJump < 0 || c.Events.RefillJump > 1 {
+		fail("Events.RefillJump: must be between 0 and 1, not %g", c.Events.RefillJump)
+	}
+	if c.Events.MaxStreams < 0 || c.Events.MaxStreamsPerIP < 0 {
+		fail("Events.MaxStreams, MaxStreamsPerIP: must not be negative")
+	}
+	if _, err := time.LoadLocation(c.TimeZone); err != nil || c.TimeZone == "" {
+		fail("TimeZone: %q is not a time zone like America/Los_Angeles", c.TimeZone)
+	}
+	validateAlerts(c.Alerts, fail)
+	c.Pours.validate(fail)
+	c.Anomalies.validate(fail)
+	if c.Uptime.Cadence.Duration <= 0 {
+		fail("Uptime.Cadence: must be positive, not %s", c.Uptime.Cadence)
+	}
+	if c.Uptime.GapFactor < 1 {
+		fail("Uptime.GapFactor: must be at least 1, not %g", c.Uptime.GapFactor)
+	}
+	if c.Clock.MaxSkew.Duration <= 0 {
+		fail("Clock.MaxSkew: must be positive, not %s", c.Clock.MaxSkew)
+	}
+	if c.MQTT.Broker != "" && c.Clock.MaxSkew.Duration <= c.MQTT.Flush.Duration {
+		fail("Clock.MaxSkew: must be longer than MQTT.Flush, %s, or buffered samples look skewed", c.MQTT.Flush)
+	}
+	if c.Clock.MaxBehind.Duration != 0 && c.Clock.MaxBehind.Duration <= c.Clock.MaxSkew.Duration {
+		fail("Clock.MaxBehind: must be 0 or longer than Clock.MaxSkew, %s, not %s", c.Clock.MaxSkew, c.Clock.MaxBehind)
+	}
+	if c.Ledger.PintLitres <= 0 {
+		fail("Ledger.PintLitres: must be positive, not %g", c.Ledger.PintLitres)
+	}
+	if c.Ledger.LinkWindow.Duration < 0 {
+		fail("Ledger.LinkWindow: must not be negative, not %s", c.Ledger.LinkWindow)
+	}
+	names, pages := map[string]bool{}, map[string]bool{}
+	for i, f := range c.Fridges {
+		switch {
+		case f.Name == "" || sanitize(f.Name) != f.Name:
+			fail("Fridges[%d]: name %q must be letters, digits, '-' or '.'", i, f.Name)
+		case names[f.Name]:
+			fail("Fridges[%d]: %s is listed twice", i, f.Name)
+		}
+		names[f.Name] = true
+		if !strings.HasPrefix(f.Page, "/") {
+			fail("Fridges[%d]: page %q must start with /", i, f.Page)
+		} else if pages[f.Page] {
+			fail("Fridges[%d]: page %s is used twice", i, f.Page)
+		}
+		pages[f.Page] = true
+	}
+	t, err := parseTemplates(c.Templates)
+	if err != nil {
+		fail("Templates: %w", err)
+	} else {
+		for i, f := range c.Fridges {
+			if t.Lookup(f.template()) == nil {
+				fail("Fridges[%d]: no template named %s", i, f.template())
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// template returns the name of the template used to render the fridge's page.
+func (f FridgeConfig) template() string {
+	if f.Template != "" {
+		return f.Template
+	}
+	return f.Name + ".tmpl"
+}
+
+// redacted returns the configuration as indented JSON with secrets masked.
+func (c Config) redacted() string {
+	if c.S3.AccessKeyID != "" {
+		c.S3.AccessKeyID = "REDACTED"
+	}
+	if c.S3.SecretAccessKey != "" {
+		c.S3.SecretAccessKey = "REDACTED"
+	}
+	if c.MQTT.Password != "" {
+		c.MQTT.Password = "REDACTED"
+	}
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return string(b)
+}
+
+// configFile returns the config file to read, if any.
+func configFile() string {
+	if fn := os.Getenv("ICBMConfig"); fn != "" {
+		return fn
+	}
+	if _, err := os.Stat("icbm.json"); err == nil {
+		return "icbm.json"
+	}
+	return ""
+}
+
+// loadConfig reads the environment (and .env, if present) and the config
+// file, then sets up the templates, user database and the archive client. A
+// bad config is an error; a missing user database or S3 client is only logged
+// so maintenance commands still work with a partial setup. Only the server,
+// serving, opens the access log.
+func loadConfig(serving bool) error {
+	loadDotEnv()
+	c, err := readConfig(configFile())
+	if err != nil {
+		return err
+	}
+	t, err := parseTemplates(c.Templates)
+	if err != nil {
+		return err
+	}
+	lc := c.Log
+	if !serving {
+		lc.Access = "off"
+	}
+	if err := setupLogging(lc); err != nil {
+		return err
+	}
+	current.Store(&c)
+	templates.Store(t)
+	dataRoot = c.DataRoot
+
+	if db, err := readUserList(); err != nil {
+		slog.Warn("Could not load user database, server will be read-only", "err", err)
+	} else {
+		users.Store(&db)
+		usersLoaded.Store(true)
+		slog.Info("User database loaded", "entries", len(db))
+	}
+
+	s3client.Store(nil)
+	if c.S3.Disabled {
+		return nil
+	}
+	ar, err := newArchive(c.S3)
+	if err != nil {
+		slog.Error("Could not initialize S3 client", "err", err)
+	}
+	s3client.Store(ar)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "icbm.json")
+	os.WriteFile(fn, []byte(`{"MaxAge": "48h", "S3": {"Bucket": "test-bucket"}}`), 0600)
+	t.Setenv("ICBMChartLines", "500")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "hunter2")
+
+	c, err := readConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxAge.Duration != 48*time.Hour || c.S3.Bucket != "test-bucket" || c.ChartLines != 500 {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if c.S3.Region != defaultConfig().S3.Region {
+		t.Error("file settings should only replace what they name")
+	}
+	if r := c.redacted(); strings.Contains(r, "hunter2") {
+		t.Error("secret not redacted:", r)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := defaultConfig()
+	if err := c.validate(); err != nil {
+		t.Fatal("default config is invalid:", err)
+	}
+
+	c.HTTP = "8080"
+	c.ChartLines = 0
+	c.Fridges = append(c.Fridges, FridgeConfig{Name: "Lunarville", Page: "/bev"}, FridgeConfig{Name: "Nowhere", Page: "/nowhere"})
+	c.MQTT.Broker, c.MQTT.Flush = "tcp://localhost:1883", duration{time.Hour}
+	err := c.validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"HTTP", "ChartLines", "listed twice", "/bev is used twice", "no template named Nowhere.tmpl", "longer than MQTT.Flush"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+
+	fn := filepath.Join(t.TempDir(), "icbm.json")
+	os.WriteFile(fn, []byte(`{"Bogus": true}`), 0600)
+	if _, err := readConfig(fn); err == nil {
+		t.Error("expected unknown fields to be rejected")
+	}
+}
+
+func TestLoadConfigAccessLog(t *testing.T) {
+	keepLive(t)
+	defer func(lg *slog.Logger, ar *Archive) {
+		slog.SetDefault(lg)
+		s3client.Store(ar)
+		accessLog.Store(nil)
+	}(slog.Default(), s3client.Load())
+	example, _ := filepath.Abs("icbm.example.json")
+	t.Setenv("ICBMConfig", example)
+	t.Setenv("ICBMUserDb", `{}`)
+	t.Chdir(t.TempDir())
+
+	// Maintenance commands don't serve, so they don't log requests.
+	if err := loadConfig(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(conf().Log.AccessFile); !os.IsNotExist(err) {
+		t.Errorf("%s written by a command which doesn't serve: %v", conf().Log.AccessFile, err)
+	}
+	if err := loadConfig(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(conf().Log.AccessFile); err != nil {
+		t.Error("the server's access log wasn't opened:", err)
+	}
+	accessFile.Swap(nil).Close()
+}
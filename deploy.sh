@@ -7,9 +7,11 @@ trap 'echo "\"${_last_command}\" command failed with exit code $?."' exit
 
 ./build.sh
 scp icbm-linux-amd64 icbm.api.evq.io:
-ssh api.evq.io "sudo ./icbm-linux-amd64 -install"
+ssh api.evq.io "sudo ./icbm-linux-amd64 install serve -http :80 -https :443 \
+    -tlshosts icbm.api.evq.io,api.evq.io \
+    -cert /svc/icbm/secrets/fullchain.pem -key /svc/icbm/secrets/privkey.pem"
 
-./test-icbm.sh
+./test.sh
 
 trap '' exit
 exit 0
@@ -0,0 +1,365 @@
+package main
+
+// Diagnostics for /b/{fridge}: what the server knows about a fridge or tap,
+// so debugging one doesn't need a shell on the server.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogEntry is a warning or error logged about a fridge.
+type LogEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Err     string `json:",omitempty"`
+}
+
+// recentErrorsKept is how many warnings and errors are kept per fridge.
+const recentErrorsKept = 20
+
+// fridgeDiag is what's been seen of a series since the server started.
+type fridgeDiag struct {
+	lastReport time.Time
+	client     string // the user who sent the last report
+	reports    int
+	errors     []LogEntry
+}
+
+var (
+	diagMu sync.Mutex
+	diags  = map[string]*fridgeDiag{} // by series
+)
+
+// diag returns a series' diagnostics, creating them if needed. Requires diagMu.
+func diag(series string) *fridgeDiag {
+	d := diags[series]
+	if d == nil {
+		d = &fridgeDiag{}
+		diags[series] = d
+	}
+	return d
+}
+
+// noteReport records a report for a series arriving from a user.
+func noteReport(series, user string, at time.Time) {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	d := diag(series)
+	d.lastReport, d.client = at, user
+	d.reports++
+}
+
+// reportedBy returns the series a user last sent a report for, or "".
+func reportedBy(user string) string {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	var series string
+	var at time.Time
+	for s, d := range diags {
+		if d.client == user && d.lastReport.After(at) {
+			series, at = s, d.lastReport
+		}
+	}
+	return series
+}
+
+// fridgeErrors is a slog.Handler which keeps the warnings and errors logged
+// with a fridge attribute for the fridge's diagnostics, even those below the
+// level the handler it wraps logs.
+type fridgeErrors struct {
+	slog.Handler
+	attrs []slog.Attr // from WithAttrs
+}
+
+func (h *fridgeErrors) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= slog.LevelWarn || h.Handler.Enabled(ctx, l)
+}
+
+func (h *fridgeErrors) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		e := LogEntry{Time: r.Time, Level: r.Level.String(), Message: r.Message}
+		var fridge string
+		note := func(a slog.Attr) bool {
+			switch a.Key {
+			case "fridge":
+				fridge = a.Value.String()
+			case "err":
+				e.Err = a.Value.String()
+			}
+			return true
+		}
+		for _, a := range h.attrs {
+			note(a)
+		}
+		r.Attrs(note)
+		if fridge != "" {
+			diagMu.Lock()
+			d := diag(fridge)
+			d.errors = append(d.errors, e)
+			if len(d.errors) > recentErrorsKept {
+				d.errors = d.errors[len(d.errors)-recentErrorsKept:]
+			}
+			diagMu.Unlock()
+		}
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *fridgeErrors) WithAttrs(as []slog.Attr) slog.Handler {
+	return &fridgeErrors{h.Handler.WithAttrs(as), append(slices.Clip(h.attrs), as...)}
+}
+
+func (h *fridgeErrors) WithGroup(name string) slog.Handler {
+	return &fridgeErrors{h.Handler.WithGroup(name), h.attrs}
+}
+
+// gapsKept is how many of the latest gaps the diagnostics list.
+const gapsKept = 10
+
+// Diagnostics is the state of a fridge or tap, for /b/{fridge}.
+type Diagnostics struct {
+	Fridge          string
+	LastReport      time.Time `json:",omitzero"` // since the server started
+	Client          string    `json:",omitempty"`
+	Reports         int       // accepted since the server started
+	Stale           bool
+	FillAverage     float64
+	FillStdev       float64
+	CachedRange     duration
+	RawInMemory     int
+	StableInMemory  int
+	RawPerMinute    float64
+	StablePerMinute float64
+	ReportsOnDisk   int
+	BytesOnDisk     int64
+	Gaps            []Gap // between the samples in memory, latest last
+	Uptime          []Uptime
+	RawMassTare     int
+	RawMassFull     int
+	ClockOffset     *duration `json:",omitempty"`
+	PoursPerDay     float64   `json:",omitempty"`
+	AveragePour     float64   `json:",omitempty"` // litres
+	Anomalies       []Anomaly
+	Errors          []LogEntry `json:",omitempty"` // the latest warnings and errors logged, latest last
+}
+
+// redact drops what only admins may see: who sends the reports, and the
+// errors logged, which may name hosts, paths and credentials.
+func (dg *Diagnostics) redact() {
+	dg.Client, dg.Errors = "", nil
+}
+
+// perMinute returns how many samples a minute ss holds, sorted.
+func perMinute(ss []Sample) float64 {
+	if len(ss) < 2 {
+		return 0
+	}
+	span := ss[len(ss)-1].Timestamp.Sub(ss[0].Timestamp)
+	if span <= 0 {
+		return 0
+	}
+	return float64(len(ss)-1) / span.Minutes()
+}
+
+// diagnose gathers the diagnostics of a series.
+func diagnose(series string, t *ICBMreport) Diagnostics {
+	dg := Diagnostics{Fridge: series, Anomalies: activeAnomalies(series), Errors: []LogEntry{}}
+	if dg.Anomalies == nil {
+		dg.Anomalies = []Anomaly{}
+	}
+
+	t.mu.Lock()
+	t.sort()
+	ss := mapf(t.StableSamples, func(s []Sample, i int) float64 { return s[i].PubFillRatio })
+	if len(ss) > 0 {
+		dg.FillAverage, dg.FillStdev = average(ss), stdev(ss)
+	}
+	if n := len(t.StableSamples); n > 1 {
+		dg.CachedRange = duration{t.StableSamples[n-1].Timestamp.Sub(t.StableSamples[0].Timestamp)}
+	}
+	dg.RawInMemory, dg.StableInMemory = len(t.RawSamples), len(t.StableSamples)
+	dg.RawPerMinute, dg.StablePerMinute = perMinute(t.RawSamples), perMinute(t.StableSamples)
+	dg.Gaps = []Gap{}
+	if n := len(t.StableSamples); n > 0 {
+		dg.Gaps = findGaps(t.StableSamples, t.StableSamples[0].Timestamp, t.StableSamples[n-1].Timestamp, gapAfter())
+		dg.Gaps = dg.Gaps[max(0, len(dg.Gaps)-gapsKept):]
+	}
+	dg.RawMassTare, dg.RawMassFull = t.RawMassTare, t.RawMassFull
+	t.mu.Unlock()
+
+	dd := diskDiagnostics(series, time.Now())
+	dg.ReportsOnDisk, dg.BytesOnDisk = dd.reports, dd.bytes
+	dg.Uptime = dd.uptime
+	dg.PoursPerDay, dg.AveragePour = dd.poursPerDay, dd.averagePour
+
+	diagMu.Lock()
+	d := diag(series)
+	dg.LastReport, dg.Client, dg.Reports = d.lastReport, d.client, d.reports
+	dg.Errors = append(dg.Errors, d.errors...)
+	diagMu.Unlock()
+
+	es := fridgeStream(series)
+	es.mu.Lock()
+	dg.Stale = es.stale
+	es.mu.Unlock()
+
+	if c, ok := latestClock(series); ok {
+		dg.ClockOffset = &c.Offset
+	}
+	return dg
+}
+
+// diskDiagInterval is how long what diagnose reads from disk is reused, so
+// /b/, which anyone may ask for, doesn't read a month of samples each time.
+const diskDiagInterval = time.Minute
+
+// diskDiag is the part of a series' diagnostics read from disk.
+type diskDiag struct {
+	root        string // the data folder it was read from
+	at          time.Time
+	reports     int
+	bytes       int64
+	uptime      []Uptime
+	poursPerDay float64
+	averagePour float64
+}
+
+var (
+	diskDiagsMu sync.Mutex
+	diskDiags   = map[string]*diskDiag{} // by series
+)
+
+// diskDiagnostics returns what's on disk about a series, reusing a read less
+// than diskDiagInterval old.
+func diskDiagnostics(series string, now time.Time) diskDiag {
+	diskDiagsMu.Lock()
+	defer diskDiagsMu.Unlock()
+	if d := diskDiags[series]; d != nil && d.root == dataRoot && now.Sub(d.at) < diskDiagInterval {
+		return *d
+	}
+	d := &diskDiag{root: dataRoot, at: now, uptime: uptimes(series, now)}
+	files, _ := filepath.Glob(filepath.Join(dataRoot, series, "*.json.gz"))
+	d.reports = len(files)
+	for _, fn := range files {
+		if fi, err := os.Stat(fn); err == nil {
+			d.bytes += fi.Size()
+		}
+	}
+	if st, err := pourStats(series, now.Add(-7*24*time.Hour)); err == nil && st.Count > 0 {
+		d.poursPerDay, d.averagePour = st.PerDay, st.AverageLitres
+	}
+	diskDiags[series] = d
+	return *d
+}
+
+// text writes the diagnostics as lines of key: value.
+func (dg Diagnostics) text() string {
+	var b strings.Builder
+	p := func(format string, a ...any) { fmt.Fprintf(&b, format+"\n", a...) }
+	p("average: %0.3g ± %0.3g%%", dg.FillAverage*100, dg.FillStdev*100)
+	if dg.StableInMemory > 1 {
+		span := dg.CachedRange.Duration
+		days := int(span.Hours() / 24)
+		hours := int(math.Mod(span.Hours(), 24))
+		mins := int(math.Mod(span.Minutes(), 60))
+		p("cached-range: %dd%dh%dm", days, hours, mins)
+	}
+	if dg.PoursPerDay > 0 {
+		p("pours-per-day: %.1f", dg.PoursPerDay)
+		p("average-pour: %.2fL", dg.AveragePour)
+	}
+	if dg.ClockOffset != nil {
+		p("clock-offset: %s", *dg.ClockOffset)
+	}
+	for _, a := range dg.Anomalies {
+		p("anomaly: %s %s since %s: %s", a.Severity, a.Kind, a.Since.Format(time.RFC3339), a.Detail)
+	}
+	if !dg.LastReport.IsZero() {
+		p("last-report: %s (%s ago)", dg.LastReport.UTC().Format(time.RFC3339), time.Since(dg.LastReport).Round(time.Second))
+	}
+	if dg.Client != "" {
+		p("client: %s", dg.Client)
+	}
+	p("reports: %d", dg.Reports)
+	p("stale: %t", dg.Stale)
+	p("in-memory: %d raw, %d stable", dg.RawInMemory, dg.StableInMemory)
+	p("sample-rate: %.1f raw/min, %.2f stable/min", dg.RawPerMinute, dg.StablePerMinute)
+	p("on-disk: %d reports, %d bytes", dg.ReportsOnDisk, dg.BytesOnDisk)
+	p("calibration: tare %d, full %d", dg.RawMassTare, dg.RawMassFull)
+	if len(dg.Uptime) > 0 {
+		var ups []string
+		for _, u := range dg.Uptime {
+			ups = append(ups, fmt.Sprintf("%.1f%% %s", u.Percent, u.Period))
+		}
+		p("uptime: %s", strings.Join(ups, ", "))
+	}
+	for _, g := range dg.Gaps {
+		p("gap: %s from %s", g.Length, g.Start.UTC().Format(time.RFC3339))
+	}
+	for _, e := range dg.Errors {
+		line := e.Time.UTC().Format(time.RFC3339) + " " + e.Level + " " + e.Message
+		if e.Err != "" {
+			line += ": " + e.Err
+		}
+		p("error: %s", line)
+	}
+	return b.String()
+}
+
+// wantsJSON reports whether a request asks for JSON, with ?format=json or
+// by listing application/json in Accept before any text type.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(part)
+		switch {
+		case err != nil:
+		case mt == "application/json":
+			return true
+		case strings.HasPrefix(mt, "text/") || mt == "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// tapStatus answers /b/{fridge} with the fridge's diagnostics, as text or,
+// if asked for, JSON. The client and errors are only shown to admins.
+func tapStatus(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	fridge := path[0]
+	t := seriesReport(fridge)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	dg := diagnose(fridge, t)
+	if !isAdmin(r) {
+		dg.redact()
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dg)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(dg.text()))
+}
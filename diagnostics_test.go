@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiagnostics(t *testing.T) {
+	freshData(t)
+	t.Cleanup(func() {
+		diagMu.Lock()
+		clear(diags)
+		diagMu.Unlock()
+		diskDiagsMu.Lock()
+		clear(diskDiags)
+		diskDiagsMu.Unlock()
+	})
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(&fridgeErrors{Handler: slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError})}))
+	fridge := "Diagville"
+
+	// Two stable samples, an hour and a half without, and a last one with
+	// half a minute of raw samples.
+	now := time.Now().UTC().Truncate(time.Second)
+	stable := []Sample{
+		{Timestamp: now.Add(-2 * time.Hour), PubFillRatio: 0.5, RawMass: 550000},
+		{Timestamp: now.Add(-119 * time.Minute), PubFillRatio: 0.5, RawMass: 550000},
+		{Timestamp: now.Add(-29 * time.Minute), PubFillRatio: 0.4, RawMass: 500000},
+	}
+	raw := make([]Sample, 31)
+	for i := range raw {
+		raw[i] = Sample{Timestamp: now.Add(time.Duration(i-60) * time.Second), RawFillRatio: 0.4, RawMass: 500000 + i%2}
+	}
+	ctx := context.WithValue(t.Context(), requestInfoKey, &requestInfo{ID: "diag", User: "fridge"})
+	rep := ICBMreport{FridgeName: fridge, RawMassTare: 300000, RawMassFull: 800000, StableSamples: stable, RawSamples: raw}
+	if err := acceptReport(ctx, rep, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctxLog(ctx).Error("Couldn't do a thing", "fridge", fridge, "err", errors.New("broken"))
+	slog.Warn("Not about a fridge")
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	get := func(path, accept, key string) (string, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Icbm-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), string(b)
+	}
+
+	ct, text := get("/b/"+fridge, "text/html,*/*;q=0.8", "admin")
+	for _, want := range []string{
+		"cached-range: 0d1h31m\n", "client: fridge\n", "reports: 1\n", "stale: false\n",
+		"in-memory: 31 raw, 3 stable\n", "sample-rate: 60.0 raw/min, 0.02 stable/min\n", "on-disk: 1 reports, ",
+		"calibration: tare 300000, full 800000\n", "gap: 1h30m0s from " + stable[1].Timestamp.Format(time.RFC3339) + "\n",
+		"ERROR Couldn't do a thing: broken\n",
+	} {
+		if !strings.HasPrefix(ct, "text/plain") || !strings.Contains(text, want) {
+			t.Errorf("text diagnostics (%s) don't have %q:\n%s", ct, want, text)
+		}
+	}
+
+	for _, path := range []string{"/b/" + fridge + "?format=json", "/b/" + fridge} {
+		ct, body := get(path, "application/json", "admin")
+		var dg Diagnostics
+		if err := json.Unmarshal([]byte(body), &dg); ct != "application/json" || err != nil {
+			t.Fatalf("%s: %s %v %s", path, ct, err, body)
+		}
+		if dg.Client != "fridge" || len(dg.Gaps) != 1 || len(dg.Errors) != 1 || dg.Errors[0].Err != "broken" ||
+			dg.RawMassFull != 800000 || math.Abs(dg.RawPerMinute-60) > 1e-9 || dg.ReportsOnDisk != 1 || time.Since(dg.LastReport) > time.Minute {
+			t.Errorf("%s: unexpected diagnostics %s", path, body)
+		}
+	}
+
+	// Everyone else doesn't see who reports or what went wrong, and looking
+	// isn't a login, good or bad.
+	logins := func() (n int64) {
+		for _, name := range []string{"api_logins", "bad_logins"} {
+			if v, ok := counters.Load(name); ok {
+				n += v.(*atomic.Int64).Load()
+			}
+		}
+		return n
+	}
+	before := logins()
+	for _, key := range []string{"", "user", "nosuchkey"} {
+		if _, text := get("/b/"+fridge, "text/plain", key); !strings.Contains(text, "reports: 1\n") || strings.Contains(text, "client:") || strings.Contains(text, "broken") {
+			t.Errorf("text diagnostics with key %q not redacted:\n%s", key, text)
+		}
+		_, body := get("/b/"+fridge+"?format=json", "", key)
+		var dg Diagnostics
+		if err := json.Unmarshal([]byte(body), &dg); err != nil || dg.Client != "" || len(dg.Errors) != 0 || dg.Reports != 1 {
+			t.Errorf("json diagnostics with key %q not redacted: %v %s", key, err, body)
+		}
+	}
+	if n := logins() - before; n != 0 {
+		t.Errorf("looking at diagnostics counted %d logins", n)
+	}
+
+	// A report turned away is a warning about the fridge its sender last
+	// reported for, though warnings aren't logged.
+	req, _ := http.NewRequest("POST", srv.URL+"/icbm/v1", strings.NewReader("{not json"))
+	req.Header.Set("X-Icbm-Api-Key", "user")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad report: %v %v", err, resp)
+	}
+	if _, text := get("/b/"+fridge, "text/plain", "admin"); !strings.Contains(text, "WARN Rejected report: ") {
+		t.Errorf("rejected report not in the diagnostics:\n%s", text)
+	}
+
+	// A fridge which has only sent raw samples has no fill average yet.
+	rawOnly := ICBMreport{FridgeName: "Diagville-raw", RawMassTare: 300000, RawMassFull: 800000, RawSamples: raw}
+	if err := acceptReport(ctx, rawOnly, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get("/b/Diagville-raw?format=json", "", "admin"); !strings.Contains(body, `"FillAverage":0,`) {
+		t.Errorf("diagnostics without stable samples: %q", body)
+	}
+	if _, text := get("/b/Diagville-raw", "text/plain", "admin"); strings.Contains(text, "NaN") || !strings.Contains(text, "in-memory: 31 raw, 0 stable\n") {
+		t.Errorf("text diagnostics without stable samples:\n%s", text)
+	}
+
+	// What's on disk is read at most once a diagnostics interval.
+	rep.RawSamples, rep.StableSamples = nil, []Sample{{Timestamp: now, PubFillRatio: 0.4, RawMass: 500000}}
+	if err := acceptReport(ctx, rep, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, text := get("/b/"+fridge, "text/plain", "admin"); !strings.Contains(text, "reports: 2\n") || !strings.Contains(text, "on-disk: 1 reports, ") {
+		t.Errorf("disk read again within the interval:\n%s", text)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+// Live updates as Server-Sent Events on /events/{fridge}: new samples,
+// refills, and the fridge going quiet (stale) or reporting again (online).
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventBacklog is how many recent events each fridge keeps for clients
+// resuming with Last-Event-ID.
+const eventBacklog = 256
+
+// event is one message on a fridge's stream.
+type event struct {
+	ID   uint64
+	Type string
+	Data []byte // JSON
+}
+
+// eventStream fans a fridge's events out to its subscribers.
+type eventStream struct {
+	mu     sync.Mutex
+	seq    uint64
+	recent []event
+	subs   map[chan event]bool
+
+	fill     float64 // the last PubFillRatio seen, for spotting refills
+	haveFill bool
+	lastSeen time.Time
+	stale    bool
+}
+
+var (
+	streamsMu sync.Mutex
+	streams   = map[string]*eventStream{}
+
+	openStreamsMu sync.Mutex
+	openStreams   = map[string]int{} // by client address
+	openTotal     int
+)
+
+// holdStream counts a stream opened from ip, unless that would be more than
+// Events.MaxStreams in all or Events.MaxStreamsPerIP from ip. Each stream
+// held is released with releaseStream.
+func holdStream(ip string) bool {
+	c := conf().Events
+	openStreamsMu.Lock()
+	defer openStreamsMu.Unlock()
+	if (c.MaxStreams > 0 && openTotal >= c.MaxStreams) || (c.MaxStreamsPerIP > 0 && openStreams[ip] >= c.MaxStreamsPerIP) {
+		return false
+	}
+	openStreams[ip]++
+	openTotal++
+	return true
+}
+
+func releaseStream(ip string) {
+	openStreamsMu.Lock()
+	defer openStreamsMu.Unlock()
+	if openStreams[ip]--; openStreams[ip] <= 0 {
+		delete(openStreams, ip)
+	}
+	openTotal--
+}
+
+// fridgeStream returns the stream for a fridge, creating it if needed.
+func fridgeStream(fridge string) *eventStream {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	es := streams[fridge]
+	if es == nil {
+		// IDs carry on from a restart as they start from the clock, so a
+		// client resuming with an ID from before won't be sent old events.
+		es = &eventStream{seq: uint64(time.Now().UnixMicro()), subs: map[chan event]bool{}}
+		streams[fridge] = es
+	}
+	return es
+}
+
+// publish sends an event to every subscriber, dropping any who can't keep
+// up; they'll reconnect and resume from the backlog. Requires the lock.
+func (es *eventStream) publish(typ string, data any) {
+	b, _ := json.Marshal(data)
+	es.seq++
+	ev := event{ID: es.seq, Type: typ, Data: b}
+	es.recent = append(es.recent, ev)
+	if len(es.recent) > eventBacklog {
+		es.recent = es.recent[len(es.recent)-eventBacklog:]
+	}
+	for ch := range es.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(es.subs, ch)
+			close(ch)
+		}
+	}
+	count("events_published")
+}
+
+// subscribe returns a channel of new events, and the backlog after lastID.
+// New clients (lastID 0) only get the latest sample, and whether the fridge
+// is stale.
+func (es *eventStream) subscribe(lastID uint64) (chan event, []event) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	ch := make(chan event, 64)
+	es.subs[ch] = true
+	if lastID != 0 {
+		i := sort.Search(len(es.recent), func(i int) bool { return es.recent[i].ID > lastID })
+		return ch, append([]event(nil), es.recent[i:]...)
+	}
+	var backlog []event
+	latest := func(typ string) {
+		for i := len(es.recent) - 1; i >= 0; i-- {
+			if es.recent[i].Type == typ {
+				backlog = append(backlog, es.recent[i])
+				return
+			}
+		}
+	}
+	latest("sample")
+	if es.stale {
+		latest("stale")
+	}
+	return ch, backlog
+}
+
+func (es *eventStream) unsubscribe(ch chan event) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.subs[ch] {
+		delete(es.subs, ch)
+		close(ch)
+	}
+}
+
+// SampleEvent is the data of a sample event.
+type SampleEvent struct {
+	Fridge       string
+	Timestamp    time.Time
+	PubFillRatio float64
+	Readings     map[string]float64 `json:",omitempty"`
+}
+
+// RefillEvent is the data of a refill event.
+type RefillEvent struct {
+	Fridge    string
+	Timestamp time.Time
+	From, To  float64
+}
+
+// StatusEvent is the data of stale and online events.
+type StatusEvent struct {
+	Fridge   string
+	LastSeen time.Time
+}
+
+// publishReport announces the stable samples of a report just accepted,
+// returning any refills seen for the caller to act on, so nothing touches the
+// disk under the stream's lock.
+func publishReport(u ICBMreport) (refills []RefillEvent) {
+	ss := append([]Sample(nil), u.StableSamples...)
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Timestamp.Before(ss[j].Timestamp) })
+	var prior Sample
+	var havePrior bool
+	if len(ss) > 0 {
+		// After a restart the stream hasn't seen a fill yet, so the first
+		// report is compared with the history instead.
+		prior, havePrior = seriesReport(u.FridgeName).latestBefore(ss[0].Timestamp)
+	}
+	es := fridgeStream(u.FridgeName)
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if !es.haveFill && havePrior {
+		es.fill, es.haveFill = clamp(prior.PubFillRatio, 0.0, 1.0), true
+	}
+	es.lastSeen = time.Now()
+	if es.stale {
+		es.stale = false
+		es.publish("online", StatusEvent{u.FridgeName, es.lastSeen})
+	}
+	for _, s := range ss {
+		fill := clamp(s.PubFillRatio, 0.0, 1.0)
+		if jump := conf().Events.RefillJump; es.haveFill && jump > 0 && fill-es.fill >= jump {
+			rf := RefillEvent{u.FridgeName, s.Timestamp, es.fill, fill}
+			es.publish("refill", rf)
+			refills = append(refills, rf)
+		}
+		es.fill, es.haveFill = fill, true
+		es.publish("sample", SampleEvent{u.FridgeName, s.Timestamp, fill, s.Readings})
+	}
+	return refills
+}
+
+// watchStale announces fridges which have stopped reporting, checking every
+// interval until stop is closed.
+func watchStale(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		checkStale(time.Now())
+	}
+}
+
+// checkStale marks fridges and taps stale if they haven't reported within
+// Events.StaleAfter of now, whether they're configured or have only sent
+// data.
+func checkStale(now time.Time) {
+	names := allSeries()
+	for _, f := range conf().Fridges {
+		if !slices.Contains(names, f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	for _, name := range names {
+		es := fridgeStream(name)
+		es.mu.Lock()
+		if es.lastSeen.IsZero() {
+			es.lastSeen = now // give it a chance to report after a restart
+		}
+		if !es.stale && now.Sub(es.lastSeen) > conf().Events.StaleAfter.Duration {
+			es.stale = true
+			es.publish("stale", StatusEvent{name, es.lastSeen})
+			slog.Warn("Fridge has stopped reporting", "fridge", name, "lastSeen", es.lastSeen)
+		}
+		es.mu.Unlock()
+	}
+}
+
+// knownFridge reports whether fridge is configured or has sent data.
+func knownFridge(fridge string) bool {
+	for _, f := range conf().Fridges {
+		if f.Name == fridge {
+			return true
+		}
+	}
+	return seriesReport(fridge) != nil
+}
+
+// fridgeEvents streams a fridge's events, with the fridge name as the path.
+// Each stream holds a connection open for as long as the page is, so past
+// the limits clients get a 503, and the glass page reloads itself instead.
+func fridgeEvents(w http.ResponseWriter, r *http.Request) {
+	fridge := strings.Trim(r.URL.Path, "/")
+	if !knownFridge(fridge) {
+		http.NotFound(w, r)
+		return
+	}
+	ip := clientIP(r)
+	if !holdStream(ip) {
+		count("events_refused")
+		w.Header().Set("Retry-After", "300")
+		http.Error(w, "Too many live updates open, please reload instead", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseStream(ip)
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if id := r.URL.Query().Get("lastEventId"); id != "" {
+		lastID, _ = strconv.ParseUint(id, 10, 64)
+	}
+
+	// Streams outlive the server's read and write timeouts.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // ask proxies not to buffer
+	reqInfo(r.Context()).Fridge = fridge
+
+	es := fridgeStream(fridge)
+	ch, backlog := es.subscribe(lastID)
+	defer es.unsubscribe(ch)
+	fmt.Fprint(w, "retry: 5000\n\n") // reconnect after 5s
+	for _, ev := range backlog {
+		writeEvent(w, ev)
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(conf().Events.Heartbeat.Duration)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return // too slow, the client will resume
+			}
+			writeEvent(w, ev)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads n events from an SSE stream, as "type data" strings,
+// returning the last ID seen.
+func readEvents(t *testing.T, br *bufio.Reader, n int) ([]string, string) {
+	t.Helper()
+	var evs []string
+	var id, typ string
+	for len(evs) < n {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events: %s (got %v)", err, evs)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			typ = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			evs = append(evs, typ+" "+line[6:])
+		}
+	}
+	return evs, id
+}
+
+func TestEvents(t *testing.T) {
+	keepLive(t)
+	srv := httptest.NewServer(logRequests(Routes()))
+	defer srv.Close()
+	fridge := "Lunarville-beta"
+
+	get := func(lastID string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", srv.URL+"/events/"+fridge, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	resp, br := get("")
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	publishReport(ICBMreport{FridgeName: fridge, StableSamples: []Sample{
+		{PubFillRatio: 0.1, Timestamp: at},
+		{PubFillRatio: 0.9, Timestamp: at.Add(time.Minute)},
+	}})
+	evs, _ := readEvents(t, br, 3)
+	want := []string{
+		`sample {"Fridge":"Lunarville-beta","Timestamp":"2024-01-02T03:04:05Z","PubFillRatio":0.1}`,
+		`refill {"Fridge":"Lunarville-beta","Timestamp":"2024-01-02T03:05:05Z","From":0.1,"To":0.9}`,
+		`sample {"Fridge":"Lunarville-beta","Timestamp":"2024-01-02T03:05:05Z","PubFillRatio":0.9}`,
+	}
+	for i := range want {
+		if i >= len(evs) || evs[i] != want[i] {
+			t.Errorf("event %d: got %v, want %s", i, evs, want[i])
+		}
+	}
+	resp.Body.Close()
+
+	// A resuming client gets what it missed, a new one just the latest sample.
+	c := *conf()
+	c.Events.StaleAfter = duration{time.Minute}
+	current.Store(&c)
+	checkStale(time.Now().Add(2 * time.Minute))
+	resp, br = get("")
+	evs, id := readEvents(t, br, 2)
+	if !strings.HasPrefix(evs[0], `sample {"Fridge":"Lunarville-beta","Timestamp":"2024-01-02T03:05:05Z"`) || !strings.HasPrefix(evs[1], "stale ") {
+		t.Errorf("new client got %v", evs)
+	}
+	resp.Body.Close()
+
+	publishReport(ICBMreport{FridgeName: fridge, StableSamples: []Sample{{PubFillRatio: 0.8, Timestamp: at.Add(2 * time.Minute)}}})
+	resp, br = get(id)
+	defer resp.Body.Close()
+	evs, _ = readEvents(t, br, 2)
+	if !strings.HasPrefix(evs[0], "online ") || !strings.HasPrefix(evs[1], `sample {"Fridge":"Lunarville-beta","Timestamp":"2024-01-02T03:06:05Z"`) {
+		t.Errorf("resumed client got %v", evs)
+	}
+
+	if resp, _ := http.Get(srv.URL + "/events/nosuchfridge"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown fridge, got %d", resp.StatusCode)
+	}
+}
+
+func TestEventsAfterRestart(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Events.StaleAfter = duration{time.Minute}
+	current.Store(&c)
+	fridge, tap := "Restartville", "Restartville.stout"
+
+	// The stream is new, but the history loaded from disk was nearly empty,
+	// so the first report is a refill.
+	at := time.Now().UTC().Add(-time.Hour)
+	tapReport[fridge] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: []Sample{{PubFillRatio: 0.1, Timestamp: at}}})
+	if err := processUpdate(t.Context(), ICBMreport{FridgeName: fridge, StableSamples: []Sample{{PubFillRatio: 0.9, Timestamp: at.Add(time.Minute)}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, refills, err := readLedger(fridge); err != nil || len(refills) != 1 || refills[0].From != 0.1 {
+		t.Errorf("first report after a restart not taken for a refill: %v %+v", err, refills)
+	}
+
+	// Taps and fridges which aren't configured go stale too.
+	tapReport[tap] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: tap, TapOf: fridge, StableSamples: []Sample{{PubFillRatio: 0.5, Timestamp: at}}})
+	checkStale(time.Now())
+	checkStale(time.Now().Add(2 * time.Minute))
+	for _, series := range []string{fridge, tap} {
+		es := fridgeStream(series)
+		es.mu.Lock()
+		stale := es.stale
+		es.mu.Unlock()
+		if !stale {
+			t.Errorf("%s not marked stale", series)
+		}
+	}
+}
+
+func TestGlassPageFollowsEvents(t *testing.T) {
+	keepLive(t)
+	tapReport["Lunarville"] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: "Lunarville", StableSamples: []Sample{{PubFillRatio: 0.5, Timestamp: time.Now()}}})
+
+	page := renderPage(FridgeConfig{Name: "Lunarville"}, "Lunarville")
+	for _, want := range []string{`new EventSource("/events/Lunarville")`, "staleAfter:  1200000 ", "beer.slosh(s.PubFillRatio)"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page is missing %s", want)
+		}
+	}
+}
+
+func TestEventStreamLimits(t *testing.T) {
+	keepLive(t)
+	c := *conf()
+	c.Events.MaxStreams, c.Events.MaxStreamsPerIP = 2, 1
+	current.Store(&c)
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events/Lunarville")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("first stream: %v %v", err, resp)
+	}
+	if again, err := http.Get(srv.URL + "/events/Lunarville"); err != nil || again.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second stream from one address: expected 503, got %v %v", err, again)
+	}
+	resp.Body.Close()
+	for i := 0; ; i++ {
+		again, err := http.Get(srv.URL + "/events/Lunarville")
+		if err == nil && again.StatusCode == http.StatusOK {
+			again.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal("closing a stream didn't free its place:", err, again)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Other addresses share the total.
+	open := func() int {
+		openStreamsMu.Lock()
+		defer openStreamsMu.Unlock()
+		return openTotal
+	}
+	for i := 0; i < 100 && open() > 0; i++ {
+		time.Sleep(10 * time.Millisecond) // until the server sees the last one close
+	}
+	if !holdStream("192.0.2.1") || holdStream("192.0.2.1") || !holdStream("192.0.2.2") || holdStream("192.0.2.3") {
+		t.Error("streams not limited per address and in all")
+	}
+	releaseStream("192.0.2.1")
+	releaseStream("192.0.2.2")
+}
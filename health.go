@@ -0,0 +1,146 @@
+package main
+
+// Liveness and readiness checks, for fly.io and load balancers.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	started       = time.Now()
+	historyLoaded atomic.Bool // loadTapReports has finished
+	usersLoaded   atomic.Bool // a user database has been read successfully
+)
+
+// s3CheckInterval is how long a result from checking the archive is reused,
+// so frequent probes don't turn into a stream of S3 requests.
+const s3CheckInterval = time.Minute
+
+// s3Health caches the last check of the archive.
+var s3Health struct {
+	mu  sync.Mutex
+	ar  *Archive
+	at  time.Time
+	err error
+}
+
+// Check is the result of one readiness check.
+type Check struct {
+	Name          string
+	OK            bool
+	Detail        string `json:",omitempty"`
+	Informational bool   `json:",omitempty"` // reported, but doesn't count towards Ready
+}
+
+// Readiness is the body of a /readyz response.
+type Readiness struct {
+	Ready  bool
+	Checks []Check
+}
+
+// healthz reports the process is alive and serving.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string
+		Uptime string
+	}{"ok", time.Since(started).Round(time.Second).String()})
+}
+
+// readyz reports whether the server can do its job: history is loaded, the
+// data folder is writable, there's a user database to check API keys against,
+// and the archive is reachable (or disabled). It answers 503 until all pass.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	writeReadiness(w, readiness(r.Context(), false))
+}
+
+// readyzLocal reports whether this instance can take traffic, for fly.io's
+// check: history is loaded and the data folder is writable. Nothing which
+// every instance shares counts, so an S3 or user database problem doesn't
+// take them all out of service; the archive is listed for information.
+func readyzLocal(w http.ResponseWriter, r *http.Request) {
+	writeReadiness(w, readiness(r.Context(), true))
+}
+
+// writeReadiness answers with rd, as 503 if it isn't ready.
+func writeReadiness(w http.ResponseWriter, rd Readiness) {
+	w.Header().Set("Content-Type", "application/json")
+	if !rd.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rd)
+}
+
+// readiness runs every readiness check or, if local, those of this instance
+// alone, with the archive only for information.
+func readiness(ctx context.Context, local bool) Readiness {
+	rd := Readiness{Ready: true}
+	add := func(name string, err error, ok string) {
+		c := Check{Name: name, OK: err == nil, Detail: ok, Informational: local && name == "s3"}
+		if err != nil {
+			c.Detail = err.Error()
+			rd.Ready = rd.Ready && c.Informational
+		}
+		rd.Checks = append(rd.Checks, c)
+	}
+
+	if historyLoaded.Load() {
+		add("history", nil, "loaded")
+	} else {
+		add("history", errors.New("still loading"), "")
+	}
+	add("data", checkWritable(dataRoot), dataRoot)
+	switch {
+	case local:
+	case usersLoaded.Load():
+		add("users", nil, "loaded")
+	default:
+		add("users", errors.New("no user database, updates will be refused"), "")
+	}
+	if local {
+		// Well inside fly.io's check timeout, however slow S3 is.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+	}
+	if conf().S3.Disabled {
+		add("s3", nil, "disabled")
+	} else {
+		add("s3", checkArchive(ctx), conf().S3.Bucket)
+	}
+	return rd
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkArchive checks the archive bucket can be reached, reusing a recent
+// result for the same client.
+func checkArchive(ctx context.Context) error {
+	ar := s3client.Load()
+	s3Health.mu.Lock()
+	defer s3Health.mu.Unlock()
+	if ar == s3Health.ar && time.Since(s3Health.at) < s3CheckInterval {
+		return s3Health.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	s3Health.ar, s3Health.at, s3Health.err = ar, time.Now(), ar.Ping(ctx)
+	return s3Health.err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.S3.Disabled = true
+	current.Store(&c)
+	defer historyLoaded.Store(historyLoaded.Load())
+	defer usersLoaded.Store(usersLoaded.Load())
+
+	probe := func() (int, Readiness) {
+		return probeReady(t, readyz)
+	}
+
+	historyLoaded.Store(false)
+	usersLoaded.Store(true)
+	code, rd := probe()
+	if code != http.StatusServiceUnavailable || rd.Ready {
+		t.Errorf("expected not ready while history loads, got %d %+v", code, rd)
+	}
+	for _, c := range rd.Checks {
+		if c.OK == (c.Name == "history") {
+			t.Errorf("unexpected check result %+v", c)
+		}
+	}
+
+	historyLoaded.Store(true)
+	if code, rd := probe(); code != http.StatusOK || !rd.Ready {
+		t.Errorf("expected ready, got %d %+v", code, rd)
+	}
+
+	// Probes through a proxy see the current state.
+	h := Routes()
+	for _, path := range []string{"/healthz", "/readyz", "/readyz/local"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "no-cache") {
+			t.Errorf("%s: Cache-Control is %q", path, cc)
+		}
+	}
+
+	dataRoot = "/nonexistent/icbm"
+	if code, _ := probe(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected an unwritable data folder to fail, got %d", code)
+	}
+}
+
+// probeReady calls a readiness handler, returning its status and checks.
+func probeReady(t *testing.T, h http.HandlerFunc) (int, Readiness) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/readyz", nil))
+	var rd Readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &rd); err != nil {
+		t.Fatalf("bad readiness body %q: %s", w.Body.String(), err)
+	}
+	return w.Code, rd
+}
+
+func TestReadyzLocal(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.S3.Disabled, c.S3.Bucket = false, "icbm-test"
+	current.Store(&c)
+	defer s3client.Store(s3client.Load())
+	s3client.Store(nil)
+	defer historyLoaded.Store(historyLoaded.Load())
+	defer usersLoaded.Store(usersLoaded.Load())
+	historyLoaded.Store(true)
+	usersLoaded.Store(false)
+
+	// Without users or the archive the server as a whole isn't ready, but
+	// this instance can take traffic.
+	if code, _ := probeReady(t, readyz); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz: expected 503, got %d", code)
+	}
+	code, rd := probeReady(t, readyzLocal)
+	if code != http.StatusOK || !rd.Ready {
+		t.Errorf("/readyz/local: expected ready, got %d %+v", code, rd)
+	}
+	names := ""
+	for _, c := range rd.Checks {
+		names += " " + c.Name
+		if c.Name == "s3" && (c.OK || !c.Informational) {
+			t.Errorf("s3 should be a failed informational check: %+v", c)
+		}
+	}
+	if names != " history data s3" {
+		t.Errorf("/readyz/local checks:%s", names)
+	}
+
+	historyLoaded.Store(false)
+	if code, _ := probeReady(t, readyzLocal); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz/local while history loads: expected 503, got %d", code)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+// When the beer goes: consumption by day of the week and hour of the day,
+// worked out from the falls in the stable fill ratio. Rises are refills and
+// are left out, so restocking doesn't count as negative drinking. What's been
+// worked out is kept per series by the quarter hour, so each request only
+// reads the samples which are new since the last, and any time zone's hours
+// can be made from it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Heatmap is a fridge's consumption over a period, in litres.
+type Heatmap struct {
+	Fridge   string
+	Since    time.Time
+	Until    time.Time
+	TimeZone string
+	Litres   [7][24]float64 // by weekday, Sunday first, and hour of the day
+	Max      float64        // the largest cell
+	Total    float64
+}
+
+// kegLitres returns the size of the keg on in a series, from the catalog if
+// it says, otherwise Pours.KegLitres.
+func kegLitres(series string) float64 {
+	if b := onTap(series); b != nil && b.KegSize > 0 {
+		return b.KegSize
+	}
+	return conf().Pours.KegLitres
+}
+
+// fridgeSeries returns the fridge itself, if it has any data, and its taps.
+func fridgeSeries(fridge string) []string {
+	var all []string
+	if seriesReport(fridge) != nil {
+		all = append(all, fridge)
+	}
+	return append(all, tapsOf(fridge)...)
+}
+
+// stableSince returns the stable samples of a series since a time, sorted,
+// from memory if they're recent enough and otherwise from disk.
+func stableSince(series string, since time.Time) []Sample {
+	if since.After(time.Now().Add(-conf().MaxAge.Duration)) {
+		if r := seriesReport(series); r != nil {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.sort()
+			i := sort.Search(len(r.StableSamples), func(i int) bool { return !r.StableSamples[i].Timestamp.Before(since) })
+			return append([]Sample(nil), r.StableSamples[i:]...)
+		}
+	}
+	r := loadFridge(series, since)
+	if r == nil {
+		return nil
+	}
+	r.sort()
+	i := sort.Search(len(r.StableSamples), func(i int) bool { return !r.StableSamples[i].Timestamp.Before(since) })
+	return r.StableSamples[i:]
+}
+
+// quarter is how finely drinking is kept. Every time zone is a whole number
+// of quarter hours from UTC.
+const quarter = 15 * time.Minute
+
+// drinking is how far a series' fill ratio has fallen, by the quarter hour.
+type drinking struct {
+	mu          sync.Mutex
+	noise, jump float64   // the settings it was worked out with
+	from, until time.Time // the samples read, until is the last one's time
+	level, fill float64   // the level being drunk from, and the last fill seen
+	quarters    map[time.Time]float64
+}
+
+var (
+	drinkingMu sync.Mutex
+	drinkingBy = map[string]*drinking{} // by series folder
+)
+
+// read works out the drinking in samples newer than any read before. The
+// level only falls by more than Pours.Noise, and only rises at a refill, a
+// rise of Events.RefillJump if that's set, so jitter and wobbles aren't
+// counted as drinking. A fall across a gap longer than Events.StaleAfter is spread over
+// the gap, as when in it the beer went isn't known. Requires d.mu.
+func (d *drinking) read(ss []Sample) {
+	staleAfter := conf().Events.StaleAfter.Duration
+	for _, s := range ss {
+		fill := clamp(s.PubFillRatio, 0.0, 1.0)
+		if d.until.IsZero() {
+			d.level, d.fill, d.until = fill, fill, s.Timestamp
+			continue
+		}
+		if !s.Timestamp.After(d.until) {
+			continue // read already
+		}
+		prev, last := d.fill, d.until
+		d.fill, d.until = fill, s.Timestamp
+		if d.jump > 0 && fill > prev && fill-prev >= d.jump {
+			d.level = fill // a refill
+			continue
+		}
+		drop := d.level - fill
+		if drop <= d.noise {
+			continue // nothing drunk
+		}
+		d.level = fill
+		if gap := s.Timestamp.Sub(last); gap > staleAfter {
+			for q := last.Truncate(quarter); q.Before(s.Timestamp); q = q.Add(quarter) {
+				start, end := q, q.Add(quarter)
+				if start.Before(last) {
+					start = last
+				}
+				if end.After(s.Timestamp) {
+					end = s.Timestamp
+				}
+				d.quarters[q] += drop * end.Sub(start).Seconds() / gap.Seconds()
+			}
+			continue
+		}
+		d.quarters[s.Timestamp.Truncate(quarter)] += drop
+	}
+}
+
+// seriesDrinking returns the drinking of a series since a time, by the
+// quarter hour, reading only the samples it hasn't read before unless since
+// is further back than it's read or the settings have changed.
+func seriesDrinking(series string, since time.Time) map[time.Time]float64 {
+	key := filepath.Join(dataRoot, series)
+	drinkingMu.Lock()
+	d := drinkingBy[key]
+	if d == nil {
+		d = &drinking{}
+		drinkingBy[key] = d
+	}
+	drinkingMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	noise, jump := conf().Pours.Noise, conf().Events.RefillJump
+	if d.quarters == nil || since.Before(d.from) || d.noise != noise || d.jump != jump {
+		d.noise, d.jump, d.from, d.until, d.quarters = noise, jump, since, time.Time{}, map[time.Time]float64{}
+		d.read(stableSince(series, since))
+	} else {
+		d.read(stableSince(series, d.until))
+	}
+	if cutoff := time.Now().Add(-maxSince); d.from.Before(cutoff) {
+		d.from = cutoff // nobody can ask for older
+		for q := range d.quarters {
+			if q.Before(cutoff.Truncate(quarter)) {
+				delete(d.quarters, q)
+			}
+		}
+	}
+	out := map[time.Time]float64{}
+	for q, drop := range d.quarters {
+		if !q.Before(since.Truncate(quarter)) {
+			out[q] = drop
+		}
+	}
+	return out
+}
+
+// forgetDrinking drops what's been worked out for a series if ss go back to
+// samples it's read past, so it's worked out again with them.
+func forgetDrinking(series string, ss []Sample) {
+	drinkingMu.Lock()
+	defer drinkingMu.Unlock()
+	key := filepath.Join(dataRoot, series)
+	d := drinkingBy[key]
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range ss {
+		if !s.Timestamp.After(d.until) {
+			delete(drinkingBy, key)
+			return
+		}
+	}
+}
+
+// consumption adds up how far the fill ratio of a fridge and its taps fell
+// since a time, in litres, by the weekday and hour in loc it fell.
+func consumption(fridge string, since time.Time, loc *time.Location) Heatmap {
+	h := Heatmap{Fridge: fridge, Since: since, Until: time.Now(), TimeZone: loc.String()}
+	for _, series := range fridgeSeries(fridge) {
+		litres := kegLitres(series)
+		for q, drop := range seriesDrinking(series, since) {
+			t := q.In(loc)
+			h.Litres[t.Weekday()][t.Hour()] += drop * litres
+			h.Total += drop * litres
+		}
+	}
+	for d := range h.Litres {
+		for hr := range h.Litres[d] {
+			h.Max = max(h.Max, h.Litres[d][hr])
+		}
+	}
+	return h
+}
+
+// svg draws the heatmap, a row per weekday and a column per hour, shading
+// each cell by how much was drunk.
+func (h Heatmap) svg() string {
+	const cell, left, top = 20, 40, 20
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="10">`+"\n", left+24*cell, top+7*cell)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="black"/>`+"\n")
+	for hr := 0; hr < 24; hr += 3 {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" fill="#99a">%02d</text>`+"\n", left+hr*cell+3, top-6, hr)
+	}
+	for d := range h.Litres {
+		fmt.Fprintf(&b, `<text x="4" y="%d" fill="#99a">%s</text>`+"\n", top+d*cell+14, time.Weekday(d).String()[:3])
+		for hr, l := range h.Litres[d] {
+			shade := 0.0
+			if h.Max > 0 {
+				shade = l / h.Max
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="#F5A510" fill-opacity="%.2f" stroke="#223"><title>%s %02d:00 %.2fL</title></rect>`+"\n",
+				left+hr*cell, top+d*cell, cell, cell, 0.05+0.95*shade, time.Weekday(d), hr, l)
+		}
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// fridgeHeatmap answers /heatmap/{fridge} with the last four weeks'
+// consumption as JSON, or as an SVG image with ?format=svg. ?since= picks
+// another period and ?tz= another time zone than TimeZone.
+func fridgeHeatmap(w http.ResponseWriter, r *http.Request) {
+	fridge := strings.Trim(r.URL.Path, "/")
+	if fridge == "" || sanitize(fridge) != fridge || len(fridgeSeries(fridge)) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = fridge
+	q := r.URL.Query()
+	since, err := sinceParam(r, 28*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tz := conf().TimeZone
+	if s := q.Get("tz"); s != "" {
+		tz = s
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		http.Error(w, "tz should be a time zone like America/Los_Angeles", http.StatusBadRequest)
+		return
+	}
+
+	h := consumption(fridge, since, loc)
+	if q.Get("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(h.svg()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeatmap(t *testing.T) {
+	freshData(t)
+	fridge := "Heatville"
+
+	// A Friday evening in the last week: a drink at 18:20 and 19:00, a
+	// refill, and another drink at 19:40.
+	now := time.Now().UTC()
+	back := (int(now.Weekday()) - int(time.Friday) + 7) % 7
+	if back == 0 {
+		back = 7
+	}
+	fri := now.Truncate(24*time.Hour).AddDate(0, 0, -back).Add(18 * time.Hour)
+	fills := []float64{0.5, 0.45, 0.45, 0.4, 0.9, 0.85}
+	var ss []Sample
+	for i, f := range fills {
+		ss = append(ss, Sample{Timestamp: fri.Add(time.Duration(i) * 20 * time.Minute), PubFillRatio: f})
+	}
+	tapReport[fridge] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: ss})
+	if _, _, err := tapReport[fridge].write(fri.Format("20060102150405"), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := consumption(fridge, now.Add(-7*24*time.Hour), time.UTC)
+	litres := defaultConfig().Pours.KegLitres
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	if !near(h.Litres[time.Friday][18], 0.05*litres) || !near(h.Litres[time.Friday][19], 0.1*litres) || !near(h.Total, 0.15*litres) {
+		t.Errorf("unexpected consumption %v, total %g", h.Litres[time.Friday], h.Total)
+	}
+	for d := range h.Litres {
+		for hr, l := range h.Litres[d] {
+			if l < 0 {
+				t.Errorf("negative consumption on %s at %d", time.Weekday(d), hr)
+			}
+		}
+	}
+	// An hour east, the evening is an hour later.
+	if h := consumption(fridge, now.Add(-7*24*time.Hour), time.FixedZone("UTC+1", 3600)); !near(h.Litres[time.Friday][20], 0.1*litres) {
+		t.Errorf("time zone not applied: %v", h.Litres[time.Friday])
+	}
+
+	// A steady keg whose readings jitter, and wobble up and back, drank nothing.
+	steady := "Heatville-steady"
+	ss = nil
+	for i, f := range []float64{0.5, 0.501, 0.499, 0.5015, 0.4985, 0.5, 0.52, 0.5, 0.499, 0.501} {
+		ss = append(ss, Sample{Timestamp: fri.Add(time.Duration(i) * time.Minute), PubFillRatio: f})
+	}
+	tapReport[steady] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: steady, StableSamples: ss})
+	if h := consumption(steady, now.Add(-7*24*time.Hour), time.UTC); h.Total != 0 {
+		t.Errorf("jitter counted as drinking: %v, total %g", h.Litres[time.Friday], h.Total)
+	}
+
+	// Older history comes from disk.
+	old := fri.AddDate(0, 0, -56)
+	rep := (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: []Sample{
+		{Timestamp: old, PubFillRatio: 0.6}, {Timestamp: old.Add(time.Minute), PubFillRatio: 0.5},
+	}})
+	if _, _, err := rep.write(old.Format("20060102150405"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if h := consumption(fridge, old.Add(-time.Hour), time.UTC); !near(h.Litres[time.Friday][18], 0.15*litres) || !near(h.Total, 0.25*litres) {
+		t.Errorf("history not read from disk: %v", h.Litres[time.Friday])
+	}
+
+	// Nobody knows when in a two hour gap the level fell, so it's spread
+	// over the gap.
+	gappy := "Heatville-gappy"
+	tapReport[gappy] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: gappy, StableSamples: []Sample{
+		{Timestamp: fri.Add(-8 * time.Hour), PubFillRatio: 0.8}, {Timestamp: fri.Add(-6 * time.Hour), PubFillRatio: 0.6},
+	}})
+	if h := consumption(gappy, now.Add(-7*24*time.Hour), time.UTC); !near(h.Litres[time.Friday][10], 0.1*litres) || !near(h.Litres[time.Friday][11], 0.1*litres) {
+		t.Errorf("fall across a gap not spread over it: %v", h.Litres[time.Friday])
+	}
+	// What's new is added to what was worked out, and what's late is too.
+	for _, s := range []Sample{{Timestamp: fri.Add(-6*time.Hour + 10*time.Minute), PubFillRatio: 0.5}, {Timestamp: fri.Add(-7 * time.Hour), PubFillRatio: 0.7}} {
+		if err := processUpdate(t.Context(), ICBMreport{FridgeName: gappy, StableSamples: []Sample{s}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := consumption(gappy, now.Add(-7*24*time.Hour), time.UTC); !near(h.Litres[time.Friday][11], 0.1*litres) || !near(h.Litres[time.Friday][12], 0.1*litres) || !near(h.Total, 0.3*litres) {
+		t.Errorf("new samples not added: %v", h.Litres[time.Friday])
+	}
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	get := func(path string) (int, string, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(b)
+	}
+	code, _, body := get("/heatmap/" + fridge + "?since=168h&tz=UTC")
+	var got Heatmap
+	if err := json.Unmarshal([]byte(body), &got); code != http.StatusOK || err != nil || !near(got.Total, 0.15*litres) {
+		t.Errorf("heatmap json: %d %v %s", code, err, body)
+	}
+	if code, ct, body := get("/heatmap/" + fridge + "?format=svg"); code != http.StatusOK || ct != "image/svg+xml" || !strings.Contains(body, "<title>Friday 19:00 1.95L</title>") {
+		t.Errorf("heatmap svg: %d %s %s", code, ct, body)
+	}
+	if code, _, _ := get("/heatmap/" + fridge + "?since=100000h"); code != http.StatusBadRequest {
+		t.Errorf("since beyond a year: expected 400, got %d", code)
+	}
+	if code, _, _ := get("/heatmap/" + fridge + "?tz=Lunar/Base"); code != http.StatusBadRequest {
+		t.Errorf("bad time zone: expected 400, got %d", code)
+	}
+	if code, _, _ := get("/heatmap/nosuchfridge"); code != http.StatusNotFound {
+		t.Errorf("unknown fridge: expected 404, got %d", code)
+	}
+
+	// With RefillJump 0 there are no refills, so a wobble up isn't one.
+	c := *conf()
+	c.Events.RefillJump = 0
+	current.Store(&c)
+	norefill := "Heatville-norefill"
+	tapReport[norefill] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: norefill, StableSamples: []Sample{
+		{Timestamp: fri, PubFillRatio: 0.5}, {Timestamp: fri.Add(time.Minute), PubFillRatio: 0.53}, {Timestamp: fri.Add(2 * time.Minute), PubFillRatio: 0.45},
+	}})
+	if h := consumption(norefill, now.Add(-7*24*time.Hour), time.UTC); !near(h.Total, 0.05*litres) {
+		t.Errorf("wobble taken for a refill with RefillJump 0: total %g", h.Total)
+	}
+}
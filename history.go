@@ -3,49 +3,145 @@
 // This handles maintenance of history files.
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
-const (
-	maxAge = 31 * 24 * time.Hour // maximum number of samples to keep per fridge in memory
+var (
+	tapReportMu sync.RWMutex
+	tapReport   = make(map[string]*ICBMreport) // Records the most recent data per series. Requires tapReportMu.
 )
 
-var tapReport = make(map[string]*ICBMreport) // Records the most recent data per fridge.
+// maxSince is as far back ?since= may reach, as answering can mean reading
+// the reports on disk for the whole period.
+const maxSince = 365 * 24 * time.Hour
+
+// sinceParam returns when a request's ?since= duration reaches back to, or
+// def before now if it has none, or the zero time if def is 0 too.
+func sinceParam(r *http.Request, def time.Duration) (time.Time, error) {
+	d := def
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil || d <= 0 || d > maxSince {
+			return time.Time{}, fmt.Errorf("since should be a duration like 24h, up to %s", maxSince)
+		}
+	}
+	if d == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(-d), nil
+}
+
+// seriesReport returns the data in memory for a series, or nil if there's none.
+func seriesReport(series string) *ICBMreport {
+	tapReportMu.RLock()
+	defer tapReportMu.RUnlock()
+	return tapReport[series]
+}
+
+// allSeries returns the names of the series with data in memory, sorted.
+func allSeries() []string {
+	tapReportMu.RLock()
+	defer tapReportMu.RUnlock()
+	names := make([]string, 0, len(tapReport))
+	for name, r := range tapReport {
+		if r != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
 
 func readReport(fn string) (rep ICBMreport, err error) {
-	var r io.Reader
-	r, err = os.Open(fn)
+	b, err := os.ReadFile(fn)
 	if err != nil {
 		return rep, fmt.Errorf("couldn't open %s: %w", fn, err)
 	}
-	if strings.HasSuffix(fn, ".gz") {
+	if rep, err = parseReport(b); err != nil {
+		err = fmt.Errorf("%s: %w", fn, err)
+	}
+	return rep, err
+}
+
+// parseReport decodes a report which may or may not be gzipped.
+func parseReport(b []byte) (rep ICBMreport, err error) {
+	var r io.Reader = bytes.NewReader(b)
+	if len(b) > 1 && b[0] == 0x1f && b[1] == 0x8b {
 		r, err = gzip.NewReader(r)
 		if err != nil {
 			return rep, fmt.Errorf("couldn't wrap gunzip: %w", err)
 		}
 	}
-	b, err := ioutil.ReadAll(r)
+	b, err = ioutil.ReadAll(r)
 	if err != nil {
 		return rep, fmt.Errorf("couldn't gunzip: %w", err)
 	}
-	json.Unmarshal(b, &rep)
+	if err := json.Unmarshal(b, &rep); err != nil {
+		return rep, fmt.Errorf("couldn't decode report: %w", err)
+	}
 	rep.mu = &sync.Mutex{}
 	return rep, nil
 }
 
+// readJSONLines reads a file of one JSON value per line, returning nothing
+// if it doesn't exist.
+func readJSONLines[T any](fn string) ([]T, error) {
+	f, err := os.Open(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var vv []T
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		var v T
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filepath.Base(fn), n, err)
+		}
+		vv = append(vv, v)
+	}
+	return vv, sc.Err()
+}
+
+// appendJSONLine adds a JSON value as a line to the end of a file.
+func appendJSONLine(fn string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func readDirRe(path string, re string) (fs []fs.DirEntry, err error) {
 	ff, err := os.ReadDir(path)
 	if err != nil {
@@ -63,7 +159,7 @@ func readDirRe(path string, re string) (fs []fs.DirEntry, err error) {
 func allTaps() (s []string) {
 	ff, err := os.ReadDir(dataPath())
 	if err != nil {
-		log.Printf("couldn't read list taps %s: %s\n", dataPath(), err)
+		slog.Error("Couldn't list taps", "dir", dataPath(), "err", err)
 		return
 	}
 	for i := range ff {
@@ -81,52 +177,64 @@ func reportTime(rp string) time.Time {
 }
 
 func loadTapReports() {
-	log.Println("Loading tap reports from the last", maxAge)
-	first := time.Now().Add(-maxAge)
+	slog.Info("Loading tap reports", "since", conf().MaxAge)
 	for _, tap := range allTaps() {
-		reports, err := readDirRe(dataPath(tap), "[0-9]{8,14}.json.gz")
-		if err != nil {
-			log.Printf("couldn't read %s: %s\n", dataPath(tap), err)
-			continue
-		}
-		for i := range reports {
-			name := reports[i].Name()
-			tm := reportTime(name)
-			if tm.Before(first) {
-				continue // too old, don't bother
-			}
-
-			src := dataPath(tap, reports[i].Name())
-			rep, err := readReport(src)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			tapReport[tap] = tapReport[tap].Append(rep)
-		}
-		if t := tapReport[tap]; t != nil {
-			t.KeepSince(maxAge)
-			log.Printf("tap report %s: %d raw, %d stable samples loaded \n", t.FridgeName, len(t.RawSamples), len(t.StableSamples))
+		if t := loadFridge(tap, time.Now().Add(-conf().MaxAge.Duration)); t != nil {
+			tapReportMu.Lock()
+			tapReport[tap] = t
+			tapReportMu.Unlock()
+			slog.Info("Loaded tap report", "fridge", t.FridgeName, "raw", len(t.RawSamples), "stable", len(t.StableSamples))
 		}
 	}
+	historyLoaded.Store(true)
 }
 
-func init() {
-	go loadTapReports()
+// loadFridge reads the reports on disk for a fridge and returns the merged
+// samples since first, or nil if there are none.
+func loadFridge(tap string, first time.Time) (t *ICBMreport) {
+	reports, err := readDirRe(dataPath(tap), reportName.String())
+	if err != nil {
+		slog.Error("Couldn't list reports", "dir", dataPath(tap), "err", err)
+		return nil
+	}
+	for i := range reports {
+		name := reports[i].Name()
+		tm := reportTime(name)
+		if tm.Before(first.Truncate(24 * time.Hour)) {
+			continue // too old, don't bother
+		}
+
+		src := dataPath(tap, reports[i].Name())
+		rep, err := readReport(src)
+		if err != nil {
+			slog.Warn("Skipping report", "err", err)
+			continue
+		}
+		t = t.Append(rep)
+	}
+	if t != nil {
+		t.mu.Lock()
+		t.dedupe()
+		t.mu.Unlock()
+		t.KeepSince(time.Since(first))
+	}
+	return t
 }
 
+// repack bundles a fridge's individual reports into daily rollups, moving the
+// originals into its archive/ folder.
 func repack(fridge string) {
 	// filesystem path to this fridge's archives
 	fridgeDataPath := dataPath(fridge, ".")
 	archive := path.Join(fridgeDataPath, "archive")
 	if err := os.MkdirAll(archive, 0700); err != nil {
-		log.Printf("Couldn't create archive folder: %s", err)
+		slog.Error("Couldn't create archive folder", "err", err)
 	}
 
 	// Get a sorted list of entries under data/{fridge}/ .
-	ff, err := readDirRe(dataPath(fridge, "."), "[0-9]{14}.json.gz")
+	ff, err := readDirRe(dataPath(fridge, "."), `^[0-9]{14}(\.[0-9]+)?\.json\.gz$`)
 	if err != nil {
-		log.Printf("couldn't read data archive %s: %s\n", fridgeDataPath, err)
+		slog.Error("Couldn't read data archive", "dir", fridgeDataPath, "err", err)
 		return
 	}
 
@@ -150,7 +258,7 @@ func repack(fridge string) {
 			break // Don't bundle the current era, it's not finished yet!
 		}
 		if fera != era {
-			bundle.Save(era, "rollup for "+era)
+			bundle.Save(context.Background(), era, "rollup for "+era)
 			era = fera
 			bundle = nil
 		}
@@ -158,7 +266,7 @@ func repack(fridge string) {
 		src := dataPath(fridge, fn)
 		rep, err := readReport(src)
 		if err != nil {
-			log.Println(err)
+			slog.Warn("Skipping report", "err", err)
 			continue
 		}
 
@@ -166,5 +274,5 @@ func repack(fridge string) {
 		dst := path.Join(archive, ff[i].Name())
 		_ = os.Rename(src, dst)
 	}
-	bundle.Save(era, "rollup for "+era)
+	bundle.Save(context.Background(), era, "rollup for "+era)
 }
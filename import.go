@@ -0,0 +1,318 @@
+package main
+
+// Rebuild a data folder from a pile of reports, either a local directory (say,
+// a copy of an old volume) or an S3 prefix. Samples are merged and
+// de-duplicated per fridge, then written back out as daily rollups and chart
+// data in the layout loadTapReports expects.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reportName = regexp.MustCompile(`^[0-9]{8,14}(\.[0-9]+)?\.json\.gz$`)
+
+// fridgeImport tallies what was found for a single fridge.
+type fridgeImport struct {
+	Files      int
+	Raw        int
+	Stable     int
+	Duplicates int
+	Days       int
+	First      time.Time
+	Last       time.Time
+
+	report *ICBMreport
+}
+
+// importSummary describes an import, whether or not it was written.
+type importSummary struct {
+	Source  string
+	DryRun  bool
+	Files   int
+	Skipped int
+	Fridges map[string]*fridgeImport
+}
+
+// add merges a parsed report into the summary. name is the file or key it came
+// from, used to guess the fridge for reports which don't say.
+func (is *importSummary) add(name string, rep ICBMreport) {
+	fridge := sanitize(rep.FridgeName)
+	if fridge == "" {
+		fridge = fridgeFromPath(name)
+	}
+	if fridge == "" {
+		slog.Warn("import: skipping, can't tell which fridge it's from", "file", name)
+		is.Skipped++
+		return
+	}
+	rep.FridgeName = fridge
+	fi := is.Fridges[fridge]
+	if fi == nil {
+		fi = &fridgeImport{}
+		is.Fridges[fridge] = fi
+	}
+	fi.Files++
+	is.Files++
+	if fi.report == nil {
+		fi.report = &ICBMreport{FridgeName: fridge, mu: &sync.Mutex{}}
+	}
+	// The most recent calibration wins.
+	if rep.RawMassFull != 0 || rep.RawMassTare != 0 {
+		fi.report.RawMassFull, fi.report.RawMassTare = rep.RawMassFull, rep.RawMassTare
+	}
+	fi.report.Append(rep)
+}
+
+// fridgeFromPath returns the fridge folder in a data/{fridge}/[archive/]report path.
+func fridgeFromPath(name string) string {
+	dir := path.Dir(filepath.ToSlash(name))
+	if path.Base(dir) == "archive" {
+		dir = path.Dir(dir)
+	}
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return sanitize(path.Base(dir))
+}
+
+// tally de-duplicates every fridge's samples and fills in the counts.
+func (is *importSummary) tally() {
+	for _, fi := range is.Fridges {
+		r := fi.report
+		r.mu.Lock()
+		fi.Duplicates = r.dedupe()
+		fi.Raw, fi.Stable = len(r.RawSamples), len(r.StableSamples)
+		days := map[string]bool{}
+		for _, ss := range [][]Sample{r.RawSamples, r.StableSamples} {
+			for _, s := range ss {
+				days[era(s.Timestamp)] = true
+				if fi.First.IsZero() || s.Timestamp.Before(fi.First) {
+					fi.First = s.Timestamp
+				}
+				if s.Timestamp.After(fi.Last) {
+					fi.Last = s.Timestamp
+				}
+			}
+		}
+		fi.Days = len(days)
+		r.mu.Unlock()
+	}
+}
+
+// WriteTo prints a human readable summary.
+func (is *importSummary) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	verb := "imported"
+	if is.DryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(&b, "%s: %d reports read, %d skipped\n", is.Source, is.Files, is.Skipped)
+	fridges := make([]string, 0, len(is.Fridges))
+	for f := range is.Fridges {
+		fridges = append(fridges, f)
+	}
+	sort.Strings(fridges)
+	for _, f := range fridges {
+		fi := is.Fridges[f]
+		fmt.Fprintf(&b, "%s: %s %d raw, %d stable samples over %d days from %d files (%d duplicates dropped)",
+			f, verb, fi.Raw, fi.Stable, fi.Days, fi.Files, fi.Duplicates)
+		if !fi.First.IsZero() {
+			fmt.Fprintf(&b, ", %s to %s", fi.First.Format(time.RFC3339), fi.Last.Format(time.RFC3339))
+		}
+		b.WriteString("\n")
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// era returns the yyyymmdd day a sample is bundled under, per repack.
+func era(t time.Time) string {
+	return t.Local().Format("20060102")
+}
+
+// importDir reads every report under dir, including archive/ subfolders.
+func importDir(is *importSummary, dir string) error {
+	return filepath.WalkDir(dir, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !reportName.MatchString(d.Name()) {
+			return nil
+		}
+		rep, err := readReport(fn)
+		if err != nil {
+			slog.Warn("import: skipping", "err", err)
+			is.Skipped++
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, fn)
+		if rel == d.Name() {
+			rel = fn // no folder below dir, fall back to the full path
+		}
+		is.add(rel, rep)
+		return nil
+	})
+}
+
+// importS3 reads every report under prefix in the archive bucket.
+func importS3(is *importSummary, ar *Archive, prefix string) error {
+	keys, err := ar.ListAll(prefix)
+	if err != nil {
+		return fmt.Errorf("couldn't list %s: %w", prefix, err)
+	}
+	for _, key := range keys {
+		if !reportName.MatchString(path.Base(key)) {
+			continue
+		}
+		b, err := ar.Get(key)
+		if err != nil {
+			slog.Warn("import: couldn't fetch", "key", key, "err", err)
+			is.Skipped++
+			continue
+		}
+		rep, err := parseReport(b)
+		if err != nil {
+			slog.Warn("import: couldn't read", "key", key, "err", err)
+			is.Skipped++
+			continue
+		}
+		is.add(key, rep)
+	}
+	return nil
+}
+
+// importReports gathers the reports at src, which is either a directory or an
+// s3://prefix, and unless dryRun is set writes them under dataPath().
+func importReports(src string, dryRun bool) (*importSummary, error) {
+	is := &importSummary{Source: src, DryRun: dryRun, Fridges: map[string]*fridgeImport{}}
+	var err error
+	if prefix, found := strings.CutPrefix(src, "s3://"); found {
+		err = importS3(is, s3client.Load(), prefix)
+	} else {
+		err = importDir(is, src)
+	}
+	if err != nil {
+		return is, err
+	}
+	is.tally()
+	if dryRun {
+		return is, nil
+	}
+	for _, fi := range is.Fridges {
+		if err := writeImport(fi.report); err != nil {
+			return is, err
+		}
+	}
+	return is, nil
+}
+
+// writeImport splits the merged report into daily rollups, merging with any
+// rollup already on disk, and regenerates the chart data. Today's samples are
+// written as a regular report so repack bundles them once the day is over.
+func writeImport(r *ICBMreport) error {
+	today := era(time.Now())
+	days := map[string]*ICBMreport{}
+	day := func(s Sample) *ICBMreport {
+		e := era(s.Timestamp)
+		if days[e] == nil {
+			days[e] = &ICBMreport{FridgeName: r.FridgeName, RawMassFull: r.RawMassFull, RawMassTare: r.RawMassTare, mu: &sync.Mutex{}}
+		}
+		return days[e]
+	}
+	for _, s := range r.RawSamples {
+		d := day(s)
+		d.RawSamples = append(d.RawSamples, s)
+	}
+	for _, s := range r.StableSamples {
+		d := day(s)
+		d.StableSamples = append(d.StableSamples, s)
+	}
+
+	for e, d := range days {
+		fn := e
+		if e == today {
+			fn = latest(d).Local().Format("20060102150405")
+		}
+		if existing, err := readReport(dataPath(r.FridgeName, fn+".json.gz")); err == nil {
+			d.Append(existing)
+		}
+		d.mu.Lock()
+		d.dedupe()
+		d.mu.Unlock()
+		if _, _, err := d.write(fn, "import for "+e); err != nil {
+			return err
+		}
+	}
+
+	var chart strings.Builder
+	for _, s := range last(r.StableSamples, min(len(r.StableSamples), conf().ChartLines)) {
+		fmt.Fprintf(&chart, "%d\t%g\n", s.Timestamp.Unix(), clamp(s.PubFillRatio, 0.0, 1.0))
+	}
+	filename := dataPath(r.FridgeName + ".tsv")
+	if err := os.WriteFile(filename, []byte(chart.String()), 0644); err != nil {
+		return fmt.Errorf("could not write chart data: %w", err)
+	}
+	return nil
+}
+
+// latest returns the time of the most recent sample in r.
+func latest(r *ICBMreport) (t time.Time) {
+	for _, ss := range [][]Sample{r.RawSamples, r.StableSamples} {
+		for _, s := range ss {
+			if s.Timestamp.After(t) {
+				t = s.Timestamp
+			}
+		}
+	}
+	return t
+}
+
+var importUsage = `
+Usage:
+	icbm import [-dry-run] <directory | s3://prefix>
+
+Reads every yyyymmdd.json.gz rollup and yyyymmddhhmmss[.nnnnnnnnn].json.gz
+report found in the directory (including archive/ subfolders) or under the
+S3 prefix, de-duplicates the samples, and writes daily rollups and chart data
+for each fridge into the data folder.
+Existing rollups are merged rather than replaced.
+
+Options:
+	-dry-run              summarize what would be imported, write nothing
+
+Example:
+	icbm import -dry-run /mnt/old-volume/data
+	icbm import s3://data/Lunarville/
+
+`
+
+// importCmd implements `icbm import`.
+func importCmd(args []string) int {
+	fl := flag.NewFlagSet("import", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, importUsage) }
+	dryRun := fl.Bool("dry-run", false, "summarize only, write nothing")
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+	is, err := importReports(fl.Arg(0), *dryRun)
+	is.WriteTo(os.Stdout)
+	if err != nil {
+		slog.Error("import failed", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImport(t *testing.T) {
+	src := t.TempDir()
+	dataRoot = t.TempDir()
+
+	day := time.Date(2018, 9, 13, 5, 11, 32, 0, time.Local)
+	sample := func(i int) Sample {
+		return Sample{PubFillRatio: 0.5, RawMass: 600000 + i, Timestamp: day.Add(time.Duration(i) * time.Minute)}
+	}
+	write := func(fn string, samples ...Sample) {
+		r := &ICBMreport{FridgeName: "Lunarville", RawMassFull: 800000, RawMassTare: 300000, StableSamples: samples, mu: &sync.Mutex{}}
+		saved := dataRoot
+		dataRoot = src
+		defer func() { dataRoot = saved }()
+		if _, _, err := r.write(fn, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A rollup plus the archived reports it was built from, and one more day.
+	write("20180913", sample(0), sample(1), sample(2))
+	write("archive/20180913051132", sample(0), sample(1))
+	write("archive/20180913051332", sample(2))
+	write("20180914", sample(24*60))
+
+	is, err := importReports(src, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := is.Fridges["Lunarville"]
+	if fi == nil || fi.Files != 4 || fi.Stable != 4 || fi.Duplicates != 3 || fi.Days != 2 {
+		t.Fatalf("unexpected dry run summary %+v", fi)
+	}
+	if ff, _ := os.ReadDir(dataRoot); len(ff) != 0 {
+		t.Fatal("dry run wrote files")
+	}
+
+	if _, err := importReports(src, false); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := readReport(filepath.Join(dataRoot, "Lunarville", "20180913.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.StableSamples) != 3 || rep.RawMassFull != 800000 {
+		t.Errorf("rollup has %d samples, full %d", len(rep.StableSamples), rep.RawMassFull)
+	}
+	tsv, err := os.ReadFile(filepath.Join(dataRoot, "Lunarville.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(tsv), "\n"); lines != 4 {
+		t.Errorf("chart data has %d lines, expected 4", lines)
+	}
+
+	// Importing again must not grow anything.
+	if _, err := importReports(src, false); err != nil {
+		t.Fatal(err)
+	}
+	rep, _ = readReport(filepath.Join(dataRoot, "Lunarville", "20180913.json.gz"))
+	if len(rep.StableSamples) != 3 {
+		t.Errorf("re-import left %d samples, expected 3", len(rep.StableSamples))
+	}
+}
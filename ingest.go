@@ -0,0 +1,180 @@
+package main
+
+// Decoding fridge uploads. Reports may arrive compressed, as JSON, CBOR or
+// MessagePack, with their samples listed in full or delta encoded. They're
+// always stored as gzipped JSON.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// wireReport is an ICBMreport as sent, which may carry some or all of its
+// samples in the compact form.
+type wireReport struct {
+	ICBMreport
+	CompactRaw    *CompactSamples `json:",omitempty"`
+	CompactStable *CompactSamples `json:",omitempty"`
+}
+
+// CompactSamples lists samples as parallel columns of integers, each holding
+// the first value and then the difference from the one before, which CBOR
+// and MessagePack store in a byte or two apiece.
+type CompactSamples struct {
+	T []int64 // Timestamp, in Unix milliseconds
+	M []int64 // RawMass
+	P []int64 // PubFillRatio, in millionths
+	R []int64 // RawFillRatio, in millionths; if left out it's worked out from RawMass, RawMassTare and RawMassFull
+}
+
+// compactScale is the units of the fill ratios in CompactSamples.
+const compactScale = 1e6
+
+// samples undoes the delta encoding. tare and full are the report's
+// RawMassTare and RawMassFull.
+func (c *CompactSamples) samples(tare, full int) ([]Sample, error) {
+	n := len(c.T)
+	if len(c.M) != n || len(c.P) != n || (len(c.R) != 0 && len(c.R) != n) {
+		return nil, fmt.Errorf("compact samples: T, M, P and R must be the same length")
+	}
+	if len(c.R) == 0 && full == tare {
+		return nil, fmt.Errorf("compact samples: R is needed when RawMassFull and RawMassTare are equal")
+	}
+	ss := make([]Sample, n)
+	var t, m, p, r int64
+	for i := range ss {
+		t, m, p = t+c.T[i], m+c.M[i], p+c.P[i]
+		ss[i] = Sample{
+			Timestamp:    time.UnixMilli(t).UTC(),
+			RawMass:      int(m),
+			PubFillRatio: float64(p) / compactScale,
+		}
+		if len(c.R) > 0 {
+			r += c.R[i]
+			ss[i].RawFillRatio = float64(r) / compactScale
+		} else {
+			ss[i].RawFillRatio = float64(m-int64(tare)) / float64(full-tare)
+		}
+	}
+	return ss, nil
+}
+
+// decodeReport parses an uploaded report, as CBOR or MessagePack if
+// contentType says so and JSON otherwise. verbatim reports whether the body
+// was already the JSON we'd store, with nothing to expand and nothing only
+// the server may write, such as TapOf or ClockFix, or fields it doesn't know.
+func decodeReport(contentType string, body []byte) (data ICBMreport, verbatim bool, err error) {
+	var wr wireReport
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch mt {
+	case "application/cbor":
+		err = cbor.Unmarshal(body, &wr)
+	case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		err = msgpack.Unmarshal(body, &wr)
+	default:
+		// Fridges have always sent JSON, whatever they labelled it. Nothing
+		// may follow the report, or storing it as sent would keep that too.
+		dec := json.NewDecoder(bytes.NewReader(body))
+		if err = dec.Decode(&wr); err == nil && dec.Decode(&struct{}{}) != io.EOF {
+			err = errors.New("unexpected data after the report")
+		}
+		verbatim = err == nil && wr.TapOf == "" && wr.ClockFix == nil && knownFields(body)
+	}
+	if err != nil {
+		return data, false, err
+	}
+	data = wr.ICBMreport
+	for _, cs := range []struct {
+		c  *CompactSamples
+		to *[]Sample
+	}{{wr.CompactRaw, &data.RawSamples}, {wr.CompactStable, &data.StableSamples}} {
+		if cs.c == nil {
+			continue
+		}
+		ss, err := cs.c.samples(data.RawMassTare, data.RawMassFull)
+		if err != nil {
+			return data, false, err
+		}
+		*cs.to = append(*cs.to, ss...)
+		verbatim = false
+	}
+	return data, verbatim, nil
+}
+
+// knownFields reports whether a JSON report has only the fields of a
+// wireReport.
+func knownFields(body []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	return dec.Decode(&wireReport{}) == nil
+}
+
+// decodeBody reads the request body, undoing any Content-Encoding. The
+// compressed body is limited to Limits.MaxBody and the decompressed one to
+// Limits.MaxDecoded, both failing with errBodyTooLarge. If the body was
+// gzipped it's also returned as sent, so it can be stored without
+// recompressing.
+func decodeBody(w http.ResponseWriter, r *http.Request) (body, gz []byte, err error) {
+	sent, err := readBody(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var zr io.Reader
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return sent, nil, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(sent))
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad gzip body: %w", err)
+		}
+		zr, gz = gr, sent
+	case "zstd":
+		max := uint64(conf().Limits.MaxDecoded)
+		zd, err := zstd.NewReader(bytes.NewReader(sent), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(max), zstd.WithDecoderMaxWindow(max))
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad zstd body: %w", err)
+		}
+		defer zd.Close()
+		zr = zd
+	default:
+		return nil, nil, fmt.Errorf("%w %q, send gzip, zstd or identity", errUnsupportedEncoding, enc)
+	}
+
+	max := conf().Limits.MaxDecoded
+	body, err = io.ReadAll(io.LimitReader(zr, max+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't decompress the body: %w", err)
+	}
+	if int64(len(body)) > max {
+		return nil, nil, fmt.Errorf("%w, it decompresses to more than %d bytes", errBodyTooLarge, max)
+	}
+	return body, gz, nil
+}
+
+// storedAsSent reports whether the report decoded from a gzipped upload can be
+// stored byte for byte, as Save would write the same samples in the same order.
+func storedAsSent(r *ICBMreport, sentName string) bool {
+	if !conf().StoreAsSent || r.FridgeName != sentName {
+		return false
+	}
+	sorted := func(ss []Sample) bool {
+		return sort.SliceIsSorted(ss, func(i, j int) bool { return ss[i].Timestamp.Before(ss[j].Timestamp) })
+	}
+	return sorted(r.RawSamples) && sorted(r.StableSamples)
+}
@@ -1,6 +1,23 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
 
 func TestClamp(t *testing.T) {
 	if clamp(-1.0, 0.0, 1.0) < -0.1 {
@@ -16,3 +33,200 @@ func TestClamp(t *testing.T) {
 		t.Error("Clamp is not allowing safe values through")
 	}
 }
+
+func TestCompressedUploads(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.StoreAsSent = true
+	c.Limits.MaxDecoded = 64 << 10
+	c.Limits.KeyPerMinute, c.Limits.IPPerMinute = 0, 0
+	current.Store(&c)
+	apikey := randhex(32)
+	users.Store(&map[string]User{apikey: {Username: "testbot", Valid: true}})
+
+	post := func(encoding string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/icbm/v1", bytes.NewReader(body))
+		r.Header.Set("X-Icbm-Api-Key", apikey)
+		r.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		icbmUpdate(w, r)
+		return w
+	}
+	gzipped := func(s string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		io.WriteString(zw, s)
+		zw.Close()
+		return b.Bytes()
+	}
+
+	gz := gzipped(payload("gzfridge"))
+	if w := post("gzip", gz); w.Code != http.StatusOK {
+		t.Fatalf("gzip upload: %d %s", w.Code, w.Body)
+	}
+	stored, _ := filepath.Glob(filepath.Join(dataRoot, "gzfridge", "*.json.gz"))
+	if len(stored) != 1 {
+		t.Fatalf("expected one stored report, found %v", stored)
+	}
+	if b, _ := os.ReadFile(stored[0]); !bytes.Equal(b, gz) {
+		t.Error("expected the gzipped upload to be stored as sent")
+	}
+	// Anything after the report would be stored as sent too, so it's refused.
+	for _, extra := range []string{`{"FridgeName": "other"}`, "junk"} {
+		if w := post("gzip", gzipped(payload("trailfridge")+extra)); w.Code != http.StatusBadRequest {
+			t.Errorf("report followed by %s: expected 400, got %d %s", extra, w.Code, w.Body)
+		}
+	}
+	if m, _ := filepath.Glob(filepath.Join(dataRoot, "trailfridge", "*")); len(m) > 0 {
+		t.Errorf("report with trailing data stored: %v", m)
+	}
+
+	zw, _ := zstd.NewWriter(nil)
+	if w := post("zstd", zw.EncodeAll([]byte(payload("zfridge")), nil)); w.Code != http.StatusOK {
+		t.Errorf("zstd upload: %d %s", w.Code, w.Body)
+	}
+	if rep, err := readReport(mustGlob(t, filepath.Join(dataRoot, "zfridge", "*.json.gz"))); err != nil || len(rep.RawSamples) != 6 {
+		t.Errorf("zstd upload not stored correctly: %v %+v", err, rep)
+	}
+
+	bomb := gzipped(`{"FridgeName": "x", "Padding": "` + strings.Repeat("0", 1<<20) + `"}`)
+	if w := post("gzip", bomb); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("decompression bomb: expected 413, got %d %s", w.Code, w.Body)
+	}
+	if w := post("br", []byte("x")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding: expected 415, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestServerFieldsNotStoredAsSent(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.StoreAsSent = true
+	c.MaxAge.Duration = 20 * 365 * 24 * time.Hour
+	c.Limits.KeyPerMinute, c.Limits.IPPerMinute = 0, 0
+	current.Store(&c)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		io.WriteString(zw, body)
+		zw.Close()
+		r := httptest.NewRequest("POST", "/icbm/v1", &b)
+		r.Header.Set("X-Icbm-Api-Key", "user")
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		icbmUpdate(w, r)
+		return w
+	}
+	forged := strings.Replace(payload("forged"), `"FridgeName":"forged",`,
+		`"FridgeName":"forged", "TapOf": "X", "ClockFix": {"Offset": "1h", "Received": "2018-09-13T05:11:37Z"}, "Extra": 1,`, 1)
+	if w := post(forged); w.Code != http.StatusOK {
+		t.Fatalf("forged upload: %d %s", w.Code, w.Body)
+	}
+	rep, err := readReport(mustGlob(t, filepath.Join(dataRoot, "forged", "*.json.gz")))
+	if err != nil || rep.TapOf != "" || rep.ClockFix != nil {
+		t.Fatalf("client's TapOf or ClockFix stored: %v %+v", err, rep)
+	}
+
+	// Restart, and the fridge is still a fridge.
+	tapReportMu.Lock()
+	tapReport = map[string]*ICBMreport{}
+	tapReportMu.Unlock()
+	loadTapReports()
+	if r := seriesReport("forged"); r == nil || r.tapOf() != "" {
+		t.Fatalf("forged fridge loaded as %+v", r)
+	}
+	if w := post(payload("forged")); w.Code != http.StatusOK {
+		t.Errorf("report after restart: %d %s", w.Code, w.Body)
+	}
+}
+
+func mustGlob(t *testing.T, pattern string) string {
+	t.Helper()
+	m, _ := filepath.Glob(pattern)
+	if len(m) != 1 {
+		t.Fatalf("expected one match for %s, found %v", pattern, m)
+	}
+	return m[0]
+}
+
+func TestPayloadFormats(t *testing.T) {
+	want, _, err := decodeReport("application/json", []byte(payload("Lunarville")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := wireReport{ICBMreport: want}
+	cb, _ := cbor.Marshal(wr)
+	mp, _ := msgpack.Marshal(wr)
+
+	wr.RawSamples, wr.StableSamples = nil, nil
+	wr.CompactRaw, wr.CompactStable = compactSamples(want.RawSamples), compactSamples(want.StableSamples)
+	wr.CompactRaw.R = nil // worked out from the masses
+	compact, _ := cbor.Marshal(wr)
+	compactJSON, _ := json.Marshal(wr)
+
+	for _, tc := range []struct {
+		name, contentType string
+		body              []byte
+		verbatim          bool
+	}{
+		{"json", "application/json", []byte(payload("Lunarville")), true},
+		{"unlabelled json", "application/x-www-form-urlencoded", []byte(payload("Lunarville")), true},
+		{"cbor", "application/cbor", cb, false},
+		{"msgpack", "application/msgpack; charset=binary", mp, false},
+		{"compact cbor", "application/cbor", compact, false},
+		{"compact json", "", compactJSON, false},
+	} {
+		got, verbatim, err := decodeReport(tc.contentType, tc.body)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if verbatim != tc.verbatim {
+			t.Errorf("%s: verbatim is %v", tc.name, verbatim)
+		}
+		if got.FridgeName != want.FridgeName || !sameSamples(got.RawSamples, want.RawSamples) || !sameSamples(got.StableSamples, want.StableSamples) {
+			t.Errorf("%s: decoded %+v\nwanted %+v", tc.name, got, want)
+		}
+	}
+	t.Logf("json %d bytes, cbor %d, msgpack %d, compact cbor %d", len(payload("Lunarville")), len(cb), len(mp), len(compact))
+
+	wr.CompactRaw.M = wr.CompactRaw.M[1:]
+	if _, _, err := decodeReport("application/json", must(json.Marshal(wr))); err == nil {
+		t.Error("expected mismatched compact columns to be refused")
+	}
+}
+
+// sameSamples compares samples to the precision of CompactSamples.
+func sameSamples(a, b []Sample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Timestamp.Equal(b[i].Timestamp) || a[i].RawMass != b[i].RawMass ||
+			math.Abs(a[i].PubFillRatio-b[i].PubFillRatio) > 1e-6 || math.Abs(a[i].RawFillRatio-b[i].RawFillRatio) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// compactSamples delta encodes ss, the inverse of samples.
+func compactSamples(ss []Sample) *CompactSamples {
+	c := &CompactSamples{}
+	var t, m, p, r int64
+	for _, s := range ss {
+		nt, nm := s.Timestamp.UnixMilli(), int64(s.RawMass)
+		np, nr := int64(math.Round(s.PubFillRatio*compactScale)), int64(math.Round(s.RawFillRatio*compactScale))
+		c.T, c.M, c.P, c.R = append(c.T, nt-t), append(c.M, nm-m), append(c.P, np-p), append(c.R, nr-r)
+		t, m, p, r = nt, nm, np, nr
+	}
+	return c
+}
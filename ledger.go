@@ -0,0 +1,276 @@
+package main
+
+// The restock ledger: what each fridge's beer cost and who paid for it.
+// Admins record purchases and funds through /admin/ledger/{fridge}; purchases
+// are linked to the refill they paid for, from the refills seen in the fill
+// ratio. /ledger/{fridge} reports the cost per litre and pint drunk, and the
+// balance over time.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LedgerEntry is money spent on, or given for, a fridge.
+type LedgerEntry struct {
+	Time     time.Time // defaults to when it was recorded
+	Kind     string    // purchase or funds
+	Amount   float64   // in Ledger.Currency, always positive
+	Litres   float64   `json:",omitempty"` // bought
+	Beverage string    `json:",omitempty"`
+	Refill   time.Time `json:",omitzero"` // of the refill a purchase paid for
+	Note     string    `json:",omitempty"`
+}
+
+// Names of the ledger and refill logs in each series' data folder.
+const (
+	ledgerFile = "ledger.jsonl"
+	refillFile = "refills.jsonl"
+)
+
+// ledgerMu serializes changes to the ledgers and refill logs.
+var ledgerMu sync.Mutex
+
+// recordRefills adds the refills seen in a series to its refill log.
+func recordRefills(series string, refills []RefillEvent) error {
+	if len(refills) == 0 {
+		return nil
+	}
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	for _, rf := range refills {
+		if err := appendJSONLine(dataPath(series, refillFile), rf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLedger returns a series' ledger, oldest first, and its refills along
+// with those of its taps, as a fridge's refills are seen per tap. Requires
+// ledgerMu.
+func readLedger(series string) ([]LedgerEntry, []RefillEvent, error) {
+	entries, err := readJSONLines[LedgerEntry](filepath.Join(dataRoot, series, ledgerFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var refills []RefillEvent
+	for _, s := range append([]string{series}, tapsOf(series)...) {
+		rr, err := readJSONLines[RefillEvent](filepath.Join(dataRoot, s, refillFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		refills = append(refills, rr...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	sort.SliceStable(refills, func(i, j int) bool { return refills[i].Timestamp.Before(refills[j].Timestamp) })
+	return entries, refills, nil
+}
+
+// linkRefill finds the refill a purchase paid for: the one given, which must
+// have been seen, or else the nearest within Ledger.LinkWindow which no
+// other purchase has claimed. It leaves Refill zero if there's none.
+func (e *LedgerEntry) linkRefill(entries []LedgerEntry, refills []RefillEvent) error {
+	if e.Kind != "purchase" {
+		e.Refill = time.Time{}
+		return nil
+	}
+	if !e.Refill.IsZero() {
+		for _, rf := range refills {
+			if rf.Timestamp.Equal(e.Refill) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no refill was seen at %s", e.Refill.Format(time.RFC3339))
+	}
+	claimed := map[time.Time]bool{}
+	for _, o := range entries {
+		claimed[o.Refill.UTC()] = true
+	}
+	best := conf().Ledger.LinkWindow.Duration
+	for _, rf := range refills {
+		d := rf.Timestamp.Sub(e.Time).Abs()
+		if d <= best && !claimed[rf.Timestamp.UTC()] {
+			e.Refill, best = rf.Timestamp, d
+		}
+	}
+	return nil
+}
+
+// validate checks an entry from an admin.
+func (e LedgerEntry) validate() error {
+	var errs []error
+	if e.Kind != "purchase" && e.Kind != "funds" {
+		errs = append(errs, fmt.Errorf("Kind %q should be purchase or funds", e.Kind))
+	}
+	if e.Amount <= 0 || math.IsNaN(e.Amount) || math.IsInf(e.Amount, 0) {
+		errs = append(errs, fmt.Errorf("Amount must be a positive number, not %g", e.Amount))
+	}
+	if e.Litres < 0 {
+		errs = append(errs, fmt.Errorf("Litres must not be negative, not %g", e.Litres))
+	}
+	return errors.Join(errs...)
+}
+
+// BalancePoint is the balance after a ledger entry.
+type BalancePoint struct {
+	Time    time.Time
+	Balance float64
+}
+
+// LedgerReport sums up a fridge's ledger.
+type LedgerReport struct {
+	Fridge         string
+	Currency       string
+	Funded         float64
+	Spent          float64
+	Balance        float64
+	LitresBought   float64
+	LitresConsumed float64 // since the first entry, or a year ago if that's further back
+	CostPerLitre   float64 `json:",omitempty"` // spent per litre consumed
+	CostPerPint    float64 `json:",omitempty"`
+	History        []BalancePoint
+	Entries        []LedgerEntry
+	Refills        []RefillEvent
+}
+
+// ledgerReport sums up a series' ledger.
+func ledgerReport(series string) (LedgerReport, error) {
+	ledgerMu.Lock()
+	entries, refills, err := readLedger(series)
+	ledgerMu.Unlock()
+	rep := LedgerReport{Fridge: series, Currency: conf().Ledger.Currency, History: []BalancePoint{}, Entries: entries, Refills: refills}
+	if err != nil {
+		return rep, err
+	}
+	if rep.Entries == nil {
+		rep.Entries = []LedgerEntry{}
+	}
+	if rep.Refills == nil {
+		rep.Refills = []RefillEvent{}
+	}
+	for _, e := range entries {
+		switch e.Kind {
+		case "funds":
+			rep.Funded += e.Amount
+		case "purchase":
+			rep.Spent += e.Amount
+			rep.LitresBought += e.Litres
+		}
+		rep.Balance = rep.Funded - rep.Spent
+		rep.History = append(rep.History, BalancePoint{e.Time, rep.Balance})
+	}
+	if len(entries) > 0 {
+		since := entries[0].Time
+		if cutoff := time.Now().Add(-maxSince); since.Before(cutoff) {
+			since = cutoff // as far as consumption reads back
+		}
+		rep.LitresConsumed = consumption(series, since, time.UTC).Total
+	}
+	if rep.LitresConsumed > 0 {
+		rep.CostPerLitre = rep.Spent / rep.LitresConsumed
+		rep.CostPerPint = rep.CostPerLitre * conf().Ledger.PintLitres
+	}
+	return rep, nil
+}
+
+// Percent is how much of what was funded is left, for templates.
+func (l LedgerReport) Percent() float64 {
+	if l.Funded <= 0 {
+		return 0
+	}
+	return clamp(l.Balance/l.Funded*100, 0, 100)
+}
+
+// fridgeLedger answers /ledger/{fridge} with the ledger's page, or the
+// report as JSON with ?format=json.
+func fridgeLedger(w http.ResponseWriter, r *http.Request) {
+	series := strings.Trim(r.URL.Path, "/")
+	if !knownFridge(series) {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+	rep, err := ledgerReport(series)
+	if err != nil {
+		ctxLog(r.Context()).Error("Couldn't read the ledger", "fridge", series, "err", err)
+		http.Error(w, "Couldn't read the ledger", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+		return
+	}
+	var b bytes.Buffer
+	if err := templates.Load().ExecuteTemplate(&b, "ledger.tmpl", rep); err != nil {
+		slog.Error("Could not execute template", "template", "ledger.tmpl", "err", err)
+		http.Error(w, "Couldn't render the page", http.StatusInternalServerError)
+		return
+	}
+	b.WriteTo(w)
+}
+
+// adminLedger handles POST /admin/ledger/{fridge}, adding a LedgerEntry.
+func adminLedger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Please POST a ledger entry", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	series := strings.Trim(r.URL.Path, "/")
+	if series == "" || sanitize(series) != series {
+		http.Error(w, "Please name a fridge of letters, digits, '-' or '.'", http.StatusBadRequest)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+	body, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var e LedgerEntry
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, "Couldn't decode the entry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := e.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC().Truncate(time.Second)
+	}
+
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	entries, refills, err := readLedger(series)
+	if err == nil {
+		if err := e.linkRefill(entries, refills); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = appendJSONLine(dataPath(series, ledgerFile), e)
+	}
+	if err != nil {
+		ctxLog(r.Context()).Error("Couldn't update the ledger", "fridge", series, "err", err)
+		http.Error(w, "Couldn't update the ledger", http.StatusInternalServerError)
+		return
+	}
+	ctxLog(r.Context()).Info("Ledger entry added", "fridge", series, "kind", e.Kind, "amount", e.Amount)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	freshData(t)
+	fridge := "Ledgerville"
+
+	// Half a keg drunk, a refill, and a little more drunk.
+	at := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	for i, f := range []float64{0.6, 0.1, 0.95, 0.85} {
+		s := Sample{Timestamp: at.Add(time.Duration(i) * 10 * time.Minute), PubFillRatio: f}
+		if err := acceptReport(t.Context(), ICBMreport{FridgeName: fridge, StableSamples: []Sample{s}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refill := at.Add(20 * time.Minute)
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	do := func(method, path, key, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Icbm-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	stamp := func(t time.Time) string { return t.Format(time.RFC3339) }
+
+	funds := fmt.Sprintf(`{"Time": %q, "Kind": "funds", "Amount": 100, "Note": "whip-round"}`, stamp(at.Add(-time.Hour)))
+	keg := fmt.Sprintf(`{"Time": %q, "Kind": "purchase", "Amount": 50, "Litres": 19.5, "Beverage": "Oatmeal Stout"}`, stamp(at.Add(time.Hour)))
+	spare := fmt.Sprintf(`{"Time": %q, "Kind": "purchase", "Amount": 30}`, stamp(at.Add(time.Hour)))
+	for _, tc := range []struct {
+		method, key, body string
+		code              int
+	}{
+		{"POST", "", funds, http.StatusUnauthorized},
+		{"POST", "user", funds, http.StatusForbidden},
+		{"PUT", "admin", funds, http.StatusMethodNotAllowed},
+		{"POST", "admin", `{"Kind": "loan", "Amount": 5}`, http.StatusBadRequest},
+		{"POST", "admin", `{"Kind": "funds", "Amount": -5}`, http.StatusBadRequest},
+		{"POST", "admin", `{"Kind": "funds", "Amount": 0}`, http.StatusBadRequest},
+		{"POST", "admin", fmt.Sprintf(`{"Kind": "purchase", "Amount": 5, "Refill": %q}`, stamp(at)), http.StatusBadRequest},
+		{"POST", "admin", funds, http.StatusOK},
+		{"POST", "admin", keg, http.StatusOK},
+		{"POST", "admin", spare, http.StatusOK},
+	} {
+		if code, body := do(tc.method, "/admin/ledger/"+fridge, tc.key, tc.body); code != tc.code {
+			t.Errorf("%s %s with key %q: got %d, expected %d: %s", tc.method, tc.body, tc.key, code, tc.code, body)
+		}
+	}
+
+	var rep LedgerReport
+	code, body := do("GET", "/ledger/"+fridge+"?format=json", "", "")
+	if err := json.Unmarshal([]byte(body), &rep); code != http.StatusOK || err != nil {
+		t.Fatalf("ledger: %d %v %s", code, err, body)
+	}
+	if len(rep.Refills) != 1 || !rep.Refills[0].Timestamp.Equal(refill) {
+		t.Errorf("refill not recorded: %+v", rep.Refills)
+	}
+	if len(rep.Entries) != 3 || !rep.Entries[1].Refill.Equal(refill) || !rep.Entries[2].Refill.IsZero() {
+		t.Errorf("purchases linked wrongly: %+v", rep.Entries)
+	}
+	litres := 0.6 * defaultConfig().Pours.KegLitres
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	if rep.Funded != 100 || rep.Spent != 80 || rep.Balance != 20 || rep.LitresBought != 19.5 ||
+		!near(rep.LitresConsumed, litres) || !near(rep.CostPerLitre, 80/litres) || !near(rep.CostPerPint, 80/litres*0.473) {
+		t.Errorf("unexpected ledger %+v", rep)
+	}
+	if len(rep.History) != 3 || rep.History[0].Balance != 100 || rep.History[2].Balance != 20 {
+		t.Errorf("unexpected balance history %+v", rep.History)
+	}
+
+	if code, body := do("GET", "/ledger/"+fridge, "", ""); code != http.StatusOK || !strings.Contains(body, "Balance 20.00 USD of 100.00 funded") || !strings.Contains(body, "whip-round") {
+		t.Errorf("ledger page: %d %s", code, body)
+	}
+	if code, _ := do("GET", "/ledger/nosuchfridge", "", ""); code != http.StatusNotFound {
+		t.Errorf("unknown fridge: expected 404, got %d", code)
+	}
+
+	// A keg which jitters about a steady level costs what was really drunk.
+	steady := "Ledgerville-steady"
+	var ss []Sample
+	for i, f := range []float64{0.8, 0.801, 0.799, 0.8015, 0.7985, 0.8, 0.7, 0.701, 0.699, 0.7} {
+		ss = append(ss, Sample{Timestamp: at.Add(time.Duration(i) * time.Minute), PubFillRatio: f})
+	}
+	tapReport[steady] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: steady, StableSamples: ss})
+	if err := appendJSONLine(dataPath(steady, ledgerFile), LedgerEntry{Time: at.Add(-time.Hour), Kind: "purchase", Amount: 40}); err != nil {
+		t.Fatal(err)
+	}
+	litres = 0.1 * defaultConfig().Pours.KegLitres
+	if rep, err := ledgerReport(steady); err != nil || !near(rep.LitresConsumed, litres) || !near(rep.CostPerPint, 40/litres*0.473) {
+		t.Errorf("jitter counted as drinking: %v %+v", err, rep)
+	}
+
+	// A fridge's refills are seen per tap, and its purchases paid for them.
+	for i, f := range []float64{0.2, 0.9} {
+		s := Sample{Timestamp: at.Add(time.Duration(i) * 10 * time.Minute), PubFillRatio: f}
+		rep := ICBMreport{FridgeName: "Ledgertaps", Taps: []TapReport{{Name: "stout", StableSamples: []Sample{s}}}}
+		if err := acceptReport(t.Context(), rep, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	purchase := fmt.Sprintf(`{"Time": %q, "Kind": "purchase", "Amount": 50}`, stamp(at))
+	if code, body := do("POST", "/admin/ledger/Ledgertaps", "admin", purchase); code != http.StatusOK {
+		t.Fatalf("purchase for a fridge with taps: %d %s", code, body)
+	}
+	if rep, err := ledgerReport("Ledgertaps"); err != nil || len(rep.Entries) != 1 || !rep.Entries[0].Refill.Equal(at.Add(10*time.Minute)) {
+		t.Errorf("purchase not linked to the tap's refill: %v %+v", err, rep)
+	}
+}
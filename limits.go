@@ -0,0 +1,120 @@
+package main
+
+// Rate and size limits for the ingest endpoint, so a buggy or hostile client
+// can't exhaust memory or fill the data volume.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ipLimits  = newLimiter() // reports per client address, checked before the API key
+	keyLimits = newLimiter() // reports per API key
+)
+
+// limiter is a set of token buckets, one per client.
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from key's bucket, which refills at perMinute and holds
+// up to burst. If the bucket is empty it returns false and how long until the
+// next token. A perMinute of zero means unlimited.
+func (l *limiter) allow(key string, perMinute float64, burst int, now time.Time) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	rate := perMinute / 60 // tokens per second
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(rate, burst, now)
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// prune forgets buckets which have refilled, at most once a minute, so the
+// map doesn't grow with every address which ever connected.
+func (l *limiter) prune(rate float64, burst int, now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// clientIP returns the address the request came from. On fly.io requests
+// arrive through its proxy, which names the client in Fly-Client-IP.
+func clientIP(r *http.Request) string {
+	if superfly() {
+		if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooMany answers 429 with a Retry-After in whole seconds.
+func tooMany(w http.ResponseWriter, wait time.Duration) {
+	count("rate_limited")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many updates, please slow down", http.StatusTooManyRequests)
+}
+
+// tooLarge answers 413 with why.
+func tooLarge(w http.ResponseWriter, why string) {
+	count("oversize_reports")
+	http.Error(w, "Report too large: "+why, http.StatusRequestEntityTooLarge)
+}
+
+// readBody reads at most conf().Limits.MaxBody bytes of the request body,
+// returning errBodyTooLarge if there's more.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, conf().Limits.MaxBody))
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return nil, fmt.Errorf("%w, the limit is %d bytes", errBodyTooLarge, mbe.Limit)
+	}
+	return body, err
+}
+
+var errBodyTooLarge = errors.New("body too large")
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", 6, 3, now); !ok {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	ok, wait := l.allow("a", 6, 3, now)
+	if ok || wait != 10*time.Second {
+		t.Errorf("expected a refusal with a 10s wait, got %v %s", ok, wait)
+	}
+	if ok, _ := l.allow("b", 6, 3, now); !ok {
+		t.Error("another client shouldn't share the bucket")
+	}
+	if ok, _ := l.allow("a", 6, 3, now.Add(10*time.Second)); !ok {
+		t.Error("expected a token after waiting")
+	}
+	if ok, _ := l.allow("a", 0, 0, now); !ok {
+		t.Error("a rate of 0 should be unlimited")
+	}
+
+	l.allow("c", 6, 3, now.Add(2*time.Minute))
+	if len(l.buckets) != 1 {
+		t.Errorf("expected refilled buckets to be pruned, have %d", len(l.buckets))
+	}
+}
+
+func TestIngestLimits(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Limits.MaxBody = 4096
+	c.Limits.MaxSamples = 5
+	c.Limits.KeyPerMinute, c.Limits.KeyBurst = 1, 2
+	current.Store(&c)
+	apikey := randhex(32)
+	users.Store(&map[string]User{apikey: {Username: "testbot", Valid: true}})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/icbm/v1", strings.NewReader(body))
+		r.Header.Set("X-Icbm-Api-Key", apikey)
+		w := httptest.NewRecorder()
+		icbmUpdate(w, r)
+		return w
+	}
+
+	if w := post(`{"FridgeName": "x", "RawSamples": [` + strings.Repeat(`{},`, 2000) + `{}]}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: expected 413, got %d %s", w.Code, w.Body)
+	}
+	if w := post(`{"FridgeName": "x", "RawSamples": [{},{},{},{},{},{}]}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too many samples: expected 413, got %d %s", w.Code, w.Body)
+	}
+	w := post(`{"FridgeName": "x"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After once the burst is used, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
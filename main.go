@@ -1,51 +1,289 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/raylee/icbm/service"
 )
 
 var usage = `
 Usage:
-	icbm
-	icbm [--http <address:port>]
+	icbm [serve] [-http <address:port>]
+	icbm <command> [options] [arguments]
+	icbm help <command>
+
+Commands:
+	serve                 run the web server (the default)
+	repack <fridge|all>   bundle reports into daily rollups
+	verify                check the data folder for damaged or misplaced reports
+	export <fridge>       write a fridge's samples as tsv, csv or json
+	import <dir|s3://..>  rebuild the data folder from a copy or the archive
+	users <subcommand>    list or edit the API user database
+	install [server args] install (or upgrade) the systemd service, as root
+	uninstall             stop and remove the systemd service, keeping data
+
+Example:
+	./icbm -http :8080   # listen on all interfaces on port 8080
+	./icbm import -dry-run /mnt/old/data   # preview rebuilding from old data
+	./icbm help repack
+
+`
+
+// command is a subcommand of icbm, with its own flags and usage text.
+type command struct {
+	name  string
+	usage *string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"serve", &serveUsage, serveCmd},
+	{"repack", &repackUsage, repackCmd},
+	{"verify", &verifyUsage, verifyCmd},
+	{"export", &exportUsage, exportCmd},
+	{"import", &importUsage, importCmd},
+	{"users", &usersUsage, usersCmd},
+	{"install", &installUsage, installCmd},
+	{"uninstall", &uninstallUsage, uninstallCmd},
+}
+
+func lookup(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "serve" // bare flags, as in `icbm -http :8080`, mean serve
+	switch {
+	case len(args) == 0:
+	case args[0] == "-h" || args[0] == "-help" || args[0] == "--help":
+		name, args = "help", args[1:]
+	case args[0] == "-install" || args[0] == "-uninstall":
+		name, args = args[0][1:], args[1:] // as documented before subcommands
+
+	case !strings.HasPrefix(args[0], "-"):
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		if len(args) > 0 && lookup(args[0]) != nil {
+			fmt.Fprint(os.Stderr, *lookup(args[0]).usage)
+		} else {
+			fmt.Fprint(os.Stderr, usage)
+		}
+		return
+	}
+
+	cmd := lookup(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "icbm: unknown command %q\n", name)
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := loadConfig(name == "serve"); err != nil {
+		fmt.Fprintf(os.Stderr, "icbm: bad configuration:\n%s\n", err)
+		os.Exit(1)
+	}
+	code := cmd.run(args)
+
+	// Let any archive uploads the command started finish.
+	ctx, cancel := context.WithTimeout(context.Background(), conf().ShutdownTimeout.Duration)
+	if err := drain(ctx); err != nil {
+		slog.Warn("Gave up waiting for background jobs", "err", err)
+	}
+	cancel()
+	os.Exit(code)
+}
+
+var serveUsage = `
+Usage:
+	icbm serve [-http <address:port>] [-https <address:port> [-tlshosts <names>]
+	           [-cert <files> -key <files> | -selfsigned] [-redirect=false]]
 
 Options:
-	-http address         the http endpoint address (default: :8080)
+	-http address         the http endpoint address (default: HTTP from the config, :8080)
+	-https address        the https endpoint address (default: HTTPS from the config, off)
+	-tlshosts names       comma separated host names to answer https for
+	-cert files           comma separated certificate files, reloaded when changed
+	-key files            comma separated key files, one per certificate
+	-selfsigned           generate a certificate for -tlshosts (or localhost) at startup
+	-redirect             redirect http to https when https is on (default: true)
 	-help                 this message
 
+Settings are read from the JSON file named by $ICBMConfig, or icbm.json in
+the working directory, then from the environment. See icbm.example.json.
+
 Example:
-	./icbm -http :8080   # listen on all interfaces on port 8080
+	./icbm serve -http :8080   # listen on all interfaces on port 8080
+	./icbm serve -http :80 -https :443 -tlshosts icbm.lunarville.org,lunarville.org \
+		-cert /svc/icbm/secrets/fullchain.pem -key /svc/icbm/secrets/privkey.pem
+	./icbm serve -https localhost:8443 -selfsigned   # local development
 
 `
 
 var (
-	httpaddr = flag.String("http", ":8080", "serve http on address:port")
+	serveFlags = flag.NewFlagSet("serve", flag.ExitOnError)
+	httpaddr   = serveFlags.String("http", "", "serve http on address:port")
+	httpsaddr  = serveFlags.String("https", "", "serve https on address:port")
+	tlshosts   = serveFlags.String("tlshosts", "", "comma separated https host names")
+	certFiles  = serveFlags.String("cert", "", "comma separated certificate files")
+	keyFiles   = serveFlags.String("key", "", "comma separated key files")
+	selfsigned = serveFlags.Bool("selfsigned", false, "generate a self-signed certificate")
+	redirect   = serveFlags.Bool("redirect", true, "redirect http to https")
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	if superfly() {
-		log.SetFlags(0)
+// applyServeFlags overrides the configuration with any flags given to serve.
+func applyServeFlags() error {
+	c := *conf()
+	set := map[string]bool{}
+	serveFlags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["http"] {
+		c.HTTP = *httpaddr
+	}
+	if set["https"] {
+		c.HTTPS = *httpsaddr
+	}
+	if set["tlshosts"] {
+		c.TLS.Hosts = strings.Split(*tlshosts, ",")
+	}
+	if set["cert"] || set["key"] {
+		certs, keys := strings.Split(*certFiles, ","), strings.Split(*keyFiles, ",")
+		if len(certs) != len(keys) {
+			return fmt.Errorf("-cert and -key need the same number of files")
+		}
+		c.TLS.Certs = nil
+		for i := range certs {
+			c.TLS.Certs = append(c.TLS.Certs, CertPair{Cert: certs[i], Key: keys[i]})
+		}
+	}
+	if set["selfsigned"] {
+		c.TLS.SelfSigned = *selfsigned
+	}
+	if set["redirect"] {
+		c.TLS.Redirect = *redirect
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	current.Store(&c)
+	return nil
+}
+
+// serveCmd implements `icbm serve`.
+func serveCmd(args []string) int {
+	serveFlags.Usage = func() { fmt.Fprint(os.Stderr, serveUsage) }
+	serveFlags.Parse(args)
+	if err := applyServeFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "icbm serve: bad configuration:\n%s\n", err)
+		return 2
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(platform()+buildInfo()), "\n") {
+		slog.Info(line)
 	}
+
+	background(loadTapReports)
+
+	routes.Store(Routes())
+	var servers []*http.Server
+	if srv := servePrometheus(); srv != nil {
+		servers = append(servers, srv)
+	}
+	httpHandler := http.Handler(&routes)
+	if conf().HTTPS != "" {
+		certs, err := newCertStore(conf().TLS)
+		if err != nil {
+			slog.Error("Couldn't load certificates", "err", err)
+			return 1
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go certs.watch(certPoll, stop)
+		servers = append(servers, startServer(conf().HTTPS, &routes, certs.tlsConfig()))
+		if conf().TLS.Redirect {
+			httpHandler = redirectHTTPS(conf().HTTPS)
+		}
+	}
+	servers = append(servers, startServer(conf().HTTP, httpHandler, nil))
+	stopStale := make(chan struct{})
+	go watchStale(time.Minute, stopStale)
+	defer close(stopStale)
+	stopMQTT := startMQTT(conf().MQTT)
+	processSignals()
+	stopMQTT()
+	shutdown(servers...)
+	return 0
 }
 
-func main() {
-	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
-	flag.Parse()
+var installUsage = `
+Usage:
+	icbm install [-root <dir>] [server arguments]
+
+Run as root on a systemd based Linux system. Creates the svc-icbm user and
+/svc/icbm (with data/ and secrets/ folders), copies this executable to
+/svc/icbm/web, writes and enables the icbm systemd unit, and (re)starts it.
+Running it again upgrades an existing install in place. The unit runs from
+/svc/icbm, so icbm.json and .env there are picked up.
 
-	log.Print(platform())
-	log.Print(buildInfo())
+Options:
+	-root dir             install beneath dir, for staging; system commands
+	                      are printed rather than run
+
+Example:
+	sudo ./icbm install serve -http :80 -https :443 -tlshosts icbm.lunarville.org \
+		-cert /svc/icbm/secrets/fullchain.pem -key /svc/icbm/secrets/privkey.pem
+
+`
 
-	go servePrometheus()
+// installCmd implements `icbm install`.
+func installCmd(args []string) int {
+	fl := flag.NewFlagSet("install", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, installUsage) }
+	root := fl.String("root", "", "install beneath this folder")
+	fl.Parse(args)
 
-	if fridge := os.Getenv("ICBMRepack"); fridge != "" {
-		go repack(fridge)
+	in := &service.Installer{Root: *root, Args: fl.Args()}
+	if err := in.Install(); err != nil {
+		slog.Error("install failed", "err", err)
+		return 1
 	}
+	return 0
+}
 
-	server := serve(*httpaddr)
-	processSignals()
-	shutdown(server)
+var uninstallUsage = `
+Usage:
+	icbm uninstall [-root <dir>]
+
+Stops and disables the icbm service, and removes its unit file and the
+svc-icbm user. /svc/icbm and its data are left in place.
+
+Options:
+	-root dir             uninstall from beneath dir, as with install -root
+
+`
+
+// uninstallCmd implements `icbm uninstall`.
+func uninstallCmd(args []string) int {
+	fl := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, uninstallUsage) }
+	root := fl.String("root", "", "uninstall from beneath this folder")
+	fl.Parse(args)
+
+	in := &service.Installer{Root: *root}
+	if err := in.Uninstall(); err != nil {
+		slog.Error("uninstall failed", "err", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,251 @@
+package main
+
+// Maintenance subcommands which work directly against the data folder,
+// without starting the web server.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var repackUsage = `
+Usage:
+	icbm repack <fridge|all>
+
+Bundles each finished day of individual reports into a yyyymmdd.json.gz
+rollup, and moves the originals into the fridge's archive/ folder.
+
+Example:
+	icbm repack Lunarville
+	icbm repack all
+
+`
+
+// repackCmd implements `icbm repack`.
+func repackCmd(args []string) int {
+	fl := flag.NewFlagSet("repack", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, repackUsage) }
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+	fridges := []string{sanitize(fl.Arg(0))}
+	if fl.Arg(0) == "all" {
+		fridges = allTaps()
+	}
+	for _, fridge := range fridges {
+		repack(fridge)
+	}
+	return 0
+}
+
+var verifyUsage = `
+Usage:
+	icbm verify [-v]
+
+Reads every report and chart file in the data folder and lists any which
+are damaged, belong to another fridge, hold samples from the wrong day or
+from the future. Exits non-zero if anything was found.
+
+Options:
+	-v                    list every file checked
+
+`
+
+// verifyCmd implements `icbm verify`.
+func verifyCmd(args []string) int {
+	fl := flag.NewFlagSet("verify", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, verifyUsage) }
+	verbose := fl.Bool("v", false, "list every file checked")
+	fl.Parse(args)
+
+	checked, problems := verifyData(dataRoot, func(fn string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", fn, err)
+		} else if *verbose {
+			fmt.Printf("ok    %s\n", fn)
+		}
+	})
+	fmt.Printf("%d files checked, %d problems\n", checked, problems)
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyData checks the reports and chart files under root, calling report
+// for every file with the problem found, if any.
+func verifyData(root string, report func(fn string, err error)) (checked, problems int) {
+	check := func(fn string, err error) {
+		checked++
+		if err != nil {
+			problems++
+		}
+		report(fn, err)
+	}
+	filepath.WalkDir(root, func(fn string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			check(fn, err)
+		case d.IsDir():
+		case strings.HasSuffix(d.Name(), ".tsv"):
+			check(fn, verifyChart(fn))
+		case reportName.MatchString(d.Name()):
+			rel, _ := filepath.Rel(root, fn)
+			check(fn, verifyReport(fn, fridgeFromPath(rel)))
+		}
+		return nil
+	})
+	return
+}
+
+// verifyReport checks a single report file from the named fridge's folder.
+func verifyReport(fn, fridge string) error {
+	rep, err := readReport(fn)
+	if err != nil {
+		return err
+	}
+	if rep.FridgeName != fridge {
+		return fmt.Errorf("report is for %q but filed under %q", rep.FridgeName, fridge)
+	}
+	if len(rep.RawSamples)+len(rep.StableSamples) == 0 {
+		return fmt.Errorf("no samples")
+	}
+	day := filepath.Base(fn)[:8]
+	rollup := len(filepath.Base(fn)) == len("yyyymmdd.json.gz")
+	future := time.Now().Add(time.Hour)
+	for _, ss := range [][]Sample{rep.RawSamples, rep.StableSamples} {
+		for _, s := range ss {
+			if s.Timestamp.After(future) {
+				return fmt.Errorf("sample from the future: %s", s.Timestamp.Format(time.RFC3339))
+			}
+			if rollup && era(s.Timestamp) != day {
+				return fmt.Errorf("sample from %s in the rollup for %s", s.Timestamp.Format(time.RFC3339), day)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyChart checks each line of a .tsv chart file is a timestamp and a fill
+// ratio.
+func verifyChart(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		ts, fill, found := strings.Cut(sc.Text(), "\t")
+		if !found {
+			return fmt.Errorf("line %d: expected two columns", n)
+		}
+		if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+			return fmt.Errorf("line %d: bad timestamp: %w", n, err)
+		}
+		if _, err := strconv.ParseFloat(fill, 64); err != nil {
+			return fmt.Errorf("line %d: bad fill ratio: %w", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+var exportUsage = `
+Usage:
+	icbm export [-format tsv|csv|json] [-since <duration>] [-raw] [-o <file>] <fridge>
+
+Writes the samples on disk for a fridge, oldest first.
+
+Options:
+	-format name          tsv (as charted), csv (every field) or json (a report)
+	-since duration       how far back to go (default: MaxAge from the config)
+	-raw                  export RawSamples instead of StableSamples
+	-o file               write to file rather than standard output
+
+Example:
+	icbm export -format csv -since 168h Lunarville > last-week.csv
+
+`
+
+// exportCmd implements `icbm export`.
+func exportCmd(args []string) int {
+	fl := flag.NewFlagSet("export", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, exportUsage) }
+	format := fl.String("format", "tsv", "tsv, csv or json")
+	since := fl.Duration("since", conf().MaxAge.Duration, "how far back to go")
+	raw := fl.Bool("raw", false, "export RawSamples")
+	out := fl.String("o", "", "output file")
+	fl.Parse(args)
+	if fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+
+	fridge := sanitize(fl.Arg(0))
+	rep := loadFridge(fridge, time.Now().Add(-*since))
+	if rep == nil {
+		fmt.Fprintf(os.Stderr, "icbm export: no data for %s\n", fridge)
+		return 1
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "icbm export:", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := exportReport(w, rep, *format, *raw); err != nil {
+		fmt.Fprintln(os.Stderr, "icbm export:", err)
+		return 1
+	}
+	return 0
+}
+
+// exportReport writes the report's samples to w in the given format.
+func exportReport(w io.Writer, rep *ICBMreport, format string, raw bool) error {
+	samples := rep.StableSamples
+	if raw {
+		samples = rep.RawSamples
+	}
+	switch format {
+	case "tsv":
+		bw := bufio.NewWriter(w)
+		for _, s := range samples {
+			fmt.Fprintf(bw, "%d\t%g\n", s.Timestamp.Unix(), clamp(s.PubFillRatio, 0.0, 1.0))
+		}
+		return bw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Timestamp", "PubFillRatio", "RawFillRatio", "RawMass"})
+		for _, s := range samples {
+			cw.Write([]string{
+				s.Timestamp.Format(time.RFC3339),
+				strconv.FormatFloat(s.PubFillRatio, 'g', -1, 64),
+				strconv.FormatFloat(s.RawFillRatio, 'g', -1, 64),
+				strconv.Itoa(s.RawMass),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(rep)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyData(t *testing.T) {
+	dataRoot = t.TempDir()
+	day := time.Date(2018, 9, 13, 5, 11, 32, 0, time.Local)
+	good := &ICBMreport{FridgeName: "Lunarville", StableSamples: []Sample{{PubFillRatio: 0.5, Timestamp: day}}, mu: &sync.Mutex{}}
+	if _, _, err := good.write("20180913", "test"); err != nil {
+		t.Fatal(err)
+	}
+	// Filed under the wrong day.
+	if _, _, err := good.write("20180914", "test"); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dataRoot, "Lunarville", "20180915.json.gz"), []byte("not a report"), 0644)
+	os.WriteFile(filepath.Join(dataRoot, "Lunarville.tsv"), []byte("1536815492\t0.5\n"), 0644)
+
+	failed := map[string]bool{}
+	checked, problems := verifyData(dataRoot, func(fn string, err error) {
+		if err != nil {
+			failed[filepath.Base(fn)] = true
+		}
+	})
+	if checked != 4 || problems != 2 || !failed["20180914.json.gz"] || !failed["20180915.json.gz"] {
+		t.Errorf("checked %d, problems %d: %v", checked, problems, failed)
+	}
+}
+
+func TestExportReport(t *testing.T) {
+	ts := time.Date(2018, 9, 13, 5, 11, 32, 0, time.UTC)
+	rep := &ICBMreport{StableSamples: []Sample{{PubFillRatio: 1.5, RawMass: 2, Timestamp: ts}}}
+	var b bytes.Buffer
+	if err := exportReport(&b, rep, "tsv", false); err != nil || b.String() != "1536815492\t1\n" {
+		t.Errorf("tsv export: %q, %v", b.String(), err)
+	}
+	b.Reset()
+	if err := exportReport(&b, rep, "csv", false); err != nil || b.String() != "Timestamp,PubFillRatio,RawFillRatio,RawMass\n2018-09-13T05:11:32Z,1.5,0,2\n" {
+		t.Errorf("csv export: %q, %v", b.String(), err)
+	}
+	if err := exportReport(&b, rep, "xml", false); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+// An optional MQTT subscriber, for sensors which publish rather than POST.
+// Messages go through the same checks and storage as /icbm/v1 reports.
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttBridge subscribes to the configured topics and ingests what arrives.
+type mqttBridge struct {
+	client mqtt.Client
+	topics []MQTTTopic
+
+	mu      sync.Mutex
+	pending map[pendingKey]*ICBMreport // samples waiting to be flushed
+}
+
+// pendingKey is who buffered samples are from, and for which fridge.
+type pendingKey struct {
+	fridge, user string
+}
+
+// startMQTT connects to c.Broker in the background, reconnecting as needed,
+// and returns a function which flushes any pending samples and disconnects.
+// It does nothing if no broker is configured.
+func startMQTT(c MQTTConfig) (stop func()) {
+	if c.Broker == "" {
+		return func() {}
+	}
+	b := &mqttBridge{topics: c.Topics, pending: map[pendingKey]*ICBMreport{}}
+	id := c.ClientID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = "icbm-" + host
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(id).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			count("mqtt_disconnects")
+			slog.Warn("mqtt: connection lost, reconnecting", "broker", c.Broker, "err", err)
+		})
+	b.client = mqtt.NewClient(opts)
+	b.client.Connect() // completes in the background as ConnectRetry is set
+
+	done, flushed := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(flushed)
+		t := time.NewTicker(c.Flush.Duration)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				b.flush()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-flushed // so no flush outlasts stop
+		b.client.Disconnect(250)
+		b.flush()
+	}
+}
+
+// subscribe (re)subscribes to every topic, each time we connect.
+func (b *mqttBridge) subscribe(cl mqtt.Client) {
+	slog.Info("mqtt: connected")
+	for _, t := range b.topics {
+		tok := cl.Subscribe(t.Topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+			b.receive(t, m)
+		})
+		if tok.WaitTimeout(10*time.Second) && tok.Error() != nil {
+			slog.Error("mqtt: couldn't subscribe", "topic", t.Topic, "err", tok.Error())
+		}
+	}
+}
+
+// receive handles one message on a topic from t.
+func (b *mqttBridge) receive(t MQTTTopic, m mqtt.Message) {
+	if m.Retained() {
+		return // already ingested when it was first published
+	}
+	ctx := context.WithValue(context.Background(), requestInfoKey, &requestInfo{ID: newRequestID(), User: t.User})
+	lg := ctxLog(ctx).With("topic", m.Topic())
+	count("mqtt_messages")
+	user := findUser(t.User)
+	if user == nil {
+		count("bad_logins")
+		lg.Warn("mqtt: dropping message, the topic's user is unknown or disabled", "user", t.User)
+		return
+	}
+
+	switch t.Format {
+	case "report":
+		// about logs a dropped report under the fridge it names or, if it
+		// can't be read, the one the topic's user last reported for.
+		about := func(fridge string) *slog.Logger {
+			if fridge = cmp.Or(sanitize(fridge), reportedBy(t.User)); fridge != "" {
+				return lg.With("fridge", fridge)
+			}
+			return lg
+		}
+		lim := conf().Limits
+		if ok, _ := keyLimits.allow("mqtt:"+t.User, lim.KeyPerMinute, lim.KeyBurst, time.Now()); !ok {
+			count("rate_limited")
+			about("").Warn("mqtt: dropping report, rate limited")
+			return
+		}
+		if int64(len(m.Payload())) > lim.MaxBody {
+			count("oversize_reports")
+			about("").Warn("mqtt: dropping report, too large", "bytes", len(m.Payload()))
+			return
+		}
+		data, _, err := decodeReport("", m.Payload())
+		if err != nil {
+			count("bad_json")
+			about(data.FridgeName).Warn("mqtt: dropping report", "err", err)
+			return
+		}
+		if err := acceptReport(ctx, data, nil); err != nil {
+			if errors.Is(err, errTooManySamples) {
+				count("oversize_reports")
+			}
+			about(data.FridgeName).Warn("mqtt: dropping report", "err", err)
+		}
+	case "raw", "stable":
+		var s Sample
+		if err := json.Unmarshal(m.Payload(), &s); err != nil {
+			count("bad_json")
+			lg.Warn("mqtt: dropping sample", "err", err)
+			return
+		}
+		b.add(t, s)
+	}
+}
+
+// add buffers a sample until the next flush.
+func (b *mqttBridge) add(t MQTTTopic, s Sample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := pendingKey{t.Fridge, t.User}
+	r := b.pending[k]
+	if r == nil {
+		r = &ICBMreport{FridgeName: t.Fridge}
+		b.pending[k] = r
+	}
+	if len(r.RawSamples)+len(r.StableSamples) >= conf().Limits.MaxSamples {
+		count("mqtt_dropped_samples")
+		return
+	}
+	if t.Format == "stable" {
+		r.StableSamples = append(r.StableSamples, s)
+	} else {
+		r.RawSamples = append(r.RawSamples, s)
+	}
+}
+
+// flush ingests the buffered samples as one report per fridge and user,
+// rate limited like the user's reports.
+func (b *mqttBridge) flush() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = map[pendingKey]*ICBMreport{}
+	b.mu.Unlock()
+	lim := conf().Limits
+	for k, r := range pending {
+		ctx := context.WithValue(context.Background(), requestInfoKey, &requestInfo{ID: newRequestID(), Fridge: k.fridge, User: k.user})
+		if ok, _ := keyLimits.allow("mqtt:"+k.user, lim.KeyPerMinute, lim.KeyBurst, time.Now()); !ok {
+			count("rate_limited")
+			ctxLog(ctx).Warn("mqtt: dropping samples, rate limited", "fridge", k.fridge)
+			continue
+		}
+		if err := acceptReport(ctx, *r, nil); err != nil {
+			ctxLog(ctx).Warn("mqtt: dropping samples", "fridge", k.fridge, "err", err)
+		}
+	}
+}
+
+// findUser returns the enabled user called name, or nil.
+func findUser(name string) *User {
+	for _, u := range userDB() {
+		if u.Username == name && u.Valid {
+			return &u
+		}
+	}
+	return nil
+}
+
+// validate checks an MQTT configuration, calling fail for each problem.
+func (c MQTTConfig) validate(fail func(format string, a ...any)) {
+	if c.Broker == "" {
+		return
+	}
+	if u, err := url.Parse(c.Broker); err != nil || u.Scheme == "" || u.Host == "" {
+		fail("MQTT.Broker: %q is not a URL like tcp://host:1883", c.Broker)
+	}
+	if len(c.Topics) == 0 {
+		fail("MQTT.Topics: a broker is set but there's nothing to subscribe to")
+	}
+	if c.Flush.Duration <= 0 {
+		fail("MQTT.Flush: must be positive, not %s", c.Flush)
+	}
+	for i, t := range c.Topics {
+		where := fmt.Sprintf("MQTT.Topics[%d]", i)
+		if t.Topic == "" {
+			fail("%s: Topic must not be empty", where)
+		}
+		if t.User == "" {
+			fail("%s: User must name who the messages are from", where)
+		}
+		switch t.Format {
+		case "report":
+		case "raw", "stable":
+			if t.Fridge == "" || sanitize(t.Fridge) != t.Fridge {
+				fail("%s: %s samples need a Fridge of letters, digits, '-' or '.'", where, t.Format)
+			}
+		default:
+			fail("%s: Format %q should be report, raw or stable", where, t.Format)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker runs an MQTT broker for a test, returning it and its address.
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	broker := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	broker.AddHook(new(auth.AllowHook), nil)
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := broker.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() { broker.Close() })
+	return broker, tcp.Address()
+}
+
+// waitSubscribed waits for the bridge to subscribe to topic.
+func waitSubscribed(t *testing.T, broker *mochi.Server, topic string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(broker.Topics.Subscribers(topic).Subscriptions) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the bridge never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTIngest(t *testing.T) {
+	freshData(t)
+	users.Store(&map[string]User{randhex(32): {Username: "sensor", Valid: true}})
+
+	broker, addr := startBroker(t)
+	mc := MQTTConfig{
+		Broker: "tcp://" + addr,
+		Flush:  duration{time.Hour}, // flushed by stop below
+		Topics: []MQTTTopic{
+			{Topic: "icbm/+/report", User: "sensor", Format: "report"},
+			{Topic: "icbm/keg/raw", User: "sensor", Format: "raw", Fridge: "keg"},
+			{Topic: "icbm-ghost", User: "nobody", Format: "report"},
+		},
+	}
+	var errs []string
+	mc.validate(func(format string, a ...any) { errs = append(errs, format) })
+	if len(errs) > 0 {
+		t.Fatalf("config should be valid: %v", errs)
+	}
+	stop := startMQTT(mc)
+
+	waitSubscribed(t, broker, "icbm-ghost")
+	broker.Publish("icbm/mqttfridge/report", []byte(payload("mqttfridge")), false, 1)
+	broker.Publish("icbm-ghost", []byte(payload("ghost")), false, 1)
+	broker.Publish("icbm/keg/raw", []byte(`{"PubFillRatio": 0.5, "Timestamp": "2018-09-13T05:11:32Z"}`), false, 1)
+	broker.Publish("icbm/keg/raw", []byte(`{"PubFillRatio": 0.4, "Timestamp": "2018-09-13T05:11:33Z"}`), false, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if m, _ := filepath.Glob(filepath.Join(dataRoot, "mqttfridge", "*.json.gz")); len(m) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the published report was never stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) // let the samples arrive too
+	stop()
+
+	rep, err := readReport(mustGlob(t, filepath.Join(dataRoot, "keg", "*.json.gz")))
+	if err != nil || len(rep.RawSamples) != 2 {
+		t.Errorf("expected the buffered samples flushed as one report, got %v %+v", err, rep)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dataRoot, "ghost", "*")); len(m) > 0 {
+		t.Errorf("a message for an unknown user was stored: %v", m)
+	}
+	diagMu.Lock()
+	client := diag("keg").client
+	diagMu.Unlock()
+	if client != "sensor" {
+		t.Errorf("buffered samples reported by %q, not the topic's user", client)
+	}
+}
+
+func TestMQTTFlushRateLimit(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Limits.KeyPerMinute, c.Limits.KeyBurst = 1, 1
+	current.Store(&c)
+
+	b := &mqttBridge{pending: map[pendingKey]*ICBMreport{}}
+	s := Sample{PubFillRatio: 0.5, Timestamp: time.Now().UTC()}
+	user := "flusher-" + randhex(4) // with a bucket of its own
+	b.add(MQTTTopic{User: user, Format: "stable", Fridge: "flushA"}, s)
+	b.add(MQTTTopic{User: user, Format: "stable", Fridge: "flushB"}, s)
+	b.flush()
+	a, _ := filepath.Glob(filepath.Join(dataRoot, "flushA", "*.json.gz"))
+	bb, _ := filepath.Glob(filepath.Join(dataRoot, "flushB", "*.json.gz"))
+	if len(a)+len(bb) != 1 {
+		t.Errorf("expected one of two flushes within the user's rate limit, stored %v %v", a, bb)
+	}
+}
+
+// Reports for one fridge's taps arrive over MQTT and HTTP at once while its
+// pages are read. Run with -race.
+func TestMQTTConcurrentIngest(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Limits.KeyPerMinute, c.Limits.IPPerMinute = 0, 0
+	current.Store(&c)
+	apikey := randhex(32)
+	users.Store(&map[string]User{apikey: {Username: "testbot", Valid: true}, randhex(32): {Username: "sensor", Valid: true}})
+
+	broker, addr := startBroker(t)
+	stop := startMQTT(MQTTConfig{
+		Broker: "tcp://" + addr,
+		Flush:  duration{10 * time.Millisecond},
+		Topics: []MQTTTopic{
+			{Topic: "icbm/+/report", User: "sensor", Format: "report"},
+			{Topic: "icbm/Racy/stable", User: "sensor", Format: "stable", Fridge: "Racy"},
+		},
+	})
+	defer stop()
+	waitSubscribed(t, broker, "icbm/Racy/stable")
+
+	const reports = 20
+	at := time.Now().UTC().Truncate(time.Second)
+	report := func(i int) []byte {
+		s := Sample{Timestamp: at.Add(time.Duration(i) * time.Millisecond), RawMass: 1500, RawFillRatio: 0.5, PubFillRatio: 0.5, Readings: map[string]float64{"temperature": 4}}
+		b, _ := json.Marshal(ICBMreport{FridgeName: "Racy", Units: map[string]string{"temperature": "°C"}, Taps: []TapReport{
+			{Name: "stout", RawMassFull: 2000, RawMassTare: 1000, RawSamples: []Sample{s}, StableSamples: []Sample{s}, Units: map[string]string{"temperature": "°C"}},
+			{Name: "porter", RawMassFull: 2000, RawMassTare: 1000, RawSamples: []Sample{s}, StableSamples: []Sample{s}},
+		}})
+		return b
+	}
+
+	h := Routes()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < reports; i++ {
+			broker.Publish("icbm/Racy/report", report(i), false, 1)
+			broker.Publish("icbm/Racy/stable", []byte(`{"PubFillRatio": 0.5, "Timestamp": "`+at.Format(time.RFC3339)+`"}`), false, 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := reports; i < 2*reports; i++ {
+			r := httptest.NewRequest("POST", "/icbm/v1", bytes.NewReader(report(i)))
+			r.Header.Set("X-Icbm-Api-Key", apikey)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("upload: %d %s", w.Code, w.Body)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, path := range []string{"/fridge/Racy?format=json", "/fridge/Racy", "/tap/Racy/stout", "/b/Racy.porter", "/channels/Racy.stout"} {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+		}
+	}()
+
+	stable := func() int {
+		r := seriesReport("Racy.stout")
+		if r == nil {
+			return 0
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.StableSamples)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for stable() < 2*reports && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if n := stable(); n != 2*reports {
+		t.Errorf("expected %d stable samples from MQTT and HTTP, got %d", 2*reports, n)
+	}
+	if fs := summarize("Racy"); len(fs.Taps) != 2 {
+		t.Errorf("expected both taps, got %+v", fs)
+	}
+	// Reports saved in the same second don't overwrite each other.
+	saved := func() int {
+		fns, _ := filepath.Glob(filepath.Join(dataRoot, "Racy.stout", "*.json.gz"))
+		return len(fns)
+	}
+	for saved() < 2*reports && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := saved(); n != 2*reports {
+		t.Errorf("expected %d reports saved, got %d", 2*reports, n)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+// Pour detection. The raw samples arrive every second or two, fast enough to
+// see someone pulling a pint: the level leaves a steady reading, falls for a
+// few seconds, and settles lower. Each pour is announced on the fridge's
+// event stream and kept in pours.jsonl in its data folder.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pour is one glass, or jug, drawn from a fridge or tap.
+type Pour struct {
+	Start  time.Time
+	End    time.Time
+	Litres float64
+}
+
+// pourDetector follows one series' raw samples.
+type pourDetector struct {
+	last   time.Time // of the latest sample seen
+	window []Sample  // the latest Settle samples
+
+	level     float64 // the last steady fill ratio
+	haveLevel bool
+
+	pouring bool
+	start   time.Time
+	from    float64 // the level the pour started from
+}
+
+// add takes the next raw sample, returning a pour if it ended one. Samples
+// older than the latest seen are ignored.
+func (d *pourDetector) add(s Sample, p PourConfig, kegLitres float64) (Pour, bool) {
+	if !s.Timestamp.After(d.last) {
+		return Pour{}, false
+	}
+	if !d.last.IsZero() && s.Timestamp.Sub(d.last) > p.MaxGap.Duration {
+		*d = pourDetector{} // we can't tell what happened in the gap
+	}
+	prev := d.last
+	d.last = s.Timestamp
+	d.window = append(d.window, s)
+	if len(d.window) > p.Settle {
+		d.window = d.window[len(d.window)-p.Settle:]
+	}
+	if d.pouring && s.Timestamp.Sub(d.start) > p.MaxDuration.Duration {
+		// Too slow for a pour; wait for things to settle again.
+		d.pouring, d.haveLevel = false, false
+	}
+
+	fills := mapf(d.window, func(s []Sample, i int) float64 { return s[i].RawFillRatio })
+	if lo, hi := minmax(fills); len(d.window) == p.Settle && hi-lo <= p.Noise {
+		level := average(fills)
+		var pour Pour
+		found := false
+		if d.pouring {
+			litres := (d.from - level) * kegLitres
+			// The pour ended with the first of the steady samples.
+			if litres >= p.MinLitres && litres <= p.MaxLitres {
+				pour, found = Pour{Start: d.start, End: d.window[0].Timestamp, Litres: math.Round(litres*1000) / 1000}, true
+			}
+			d.pouring = false
+		}
+		d.level, d.haveLevel = level, true
+		return pour, found
+	}
+	if d.haveLevel && !d.pouring && s.RawFillRatio < d.level-p.Noise {
+		d.pouring, d.start, d.from = true, prev, d.level
+	}
+	return Pour{}, false
+}
+
+// minmax returns the smallest and largest of xs.
+func minmax(xs []float64) (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, x := range xs {
+		lo, hi = math.Min(lo, x), math.Max(hi, x)
+	}
+	return lo, hi
+}
+
+// pourFile is the name of the pour log in each series' data folder.
+const pourFile = "pours.jsonl"
+
+// poursCached is how far back the pours of each series are kept in memory,
+// enough for the pours per day on /b/{fridge} and a default /pours/{fridge}.
+const poursCached = 7 * 24 * time.Hour
+
+// pourCache is the latest pours of a series, those which started at or after
+// from.
+type pourCache struct {
+	from  time.Time
+	pours []Pour
+}
+
+var (
+	poursMu   sync.Mutex
+	detectors = map[string]*pourDetector{} // by series
+	pourLogs  = map[string]*pourCache{}    // by file name, read from disk as needed
+	firsts    = map[string]time.Time{}     // by directory, of series seen on disk
+)
+
+// detectPours runs the raw samples of a report just accepted through the
+// series' pour detector, recording any pours found.
+func detectPours(u ICBMreport) {
+	if len(u.RawSamples) == 0 {
+		return
+	}
+	p, litres := conf().Pours, kegLitres(u.FridgeName)
+	ss := append([]Sample(nil), u.RawSamples...)
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Timestamp.Before(ss[j].Timestamp) })
+
+	poursMu.Lock()
+	d := detectors[u.FridgeName]
+	if d == nil {
+		d = &pourDetector{}
+		detectors[u.FridgeName] = d
+	}
+	var pours []Pour
+	for _, s := range ss {
+		if pour, found := d.add(s, p, litres); found {
+			pours = append(pours, pour)
+		}
+	}
+	poursMu.Unlock()
+
+	for _, pour := range pours {
+		count("pours")
+		if err := recordPour(u.FridgeName, pour); err != nil {
+			slog.Error("Couldn't record a pour", "fridge", u.FridgeName, "err", err)
+		}
+		es := fridgeStream(u.FridgeName)
+		es.mu.Lock()
+		es.publish("pour", PourEvent{u.FridgeName, pour})
+		es.mu.Unlock()
+	}
+}
+
+// PourEvent is the data of a pour event.
+type PourEvent struct {
+	Fridge string
+	Pour
+}
+
+// pourLog returns the pours recorded for a series which started at or after
+// since. The last poursCached are kept in memory; anything older is read
+// from disk each time. Requires poursMu.
+func pourLog(series string, since time.Time) ([]Pour, error) {
+	fn := filepath.Join(dataRoot, series, pourFile)
+	from := time.Now().Add(-poursCached)
+	c := pourLogs[fn]
+	if c == nil || since.Before(c.from) {
+		all, err := readJSONLines[Pour](fn)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			c = &pourCache{from: from, pours: pourSince(all, from)}
+			pourLogs[fn] = c
+		}
+		if since.Before(c.from) {
+			return pourSince(all, since), nil
+		}
+	}
+	if c.from.Before(from) {
+		c.from, c.pours = from, pourSince(c.pours, from)
+	}
+	return pourSince(c.pours, since), nil
+}
+
+// pourSince returns the pours in ps which started at or after since.
+func pourSince(ps []Pour, since time.Time) []Pour {
+	var kept []Pour
+	for _, p := range ps {
+		if !p.Start.Before(since) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// recordPour appends a pour to the series' log, and to the pours cached if
+// they weren't just read from it.
+func recordPour(series string, p Pour) error {
+	if err := appendJSONLine(dataPath(series, pourFile), p); err != nil {
+		return err
+	}
+	poursMu.Lock()
+	defer poursMu.Unlock()
+	c := pourLogs[filepath.Join(dataRoot, series, pourFile)]
+	if c != nil && !p.Start.Before(c.from) && !slices.ContainsFunc(c.pours, func(o Pour) bool { return o.Start.Equal(p.Start) }) {
+		c.pours = append(c.pours, p)
+	}
+	return nil
+}
+
+// firstReported returns when the earliest report of a series on disk was
+// received, or the zero time if there are none. Once found it's remembered,
+// and kept up to date by noteSaved.
+func firstReported(series string) time.Time {
+	dir := filepath.Join(dataRoot, series)
+	poursMu.Lock()
+	t, ok := firsts[dir]
+	poursMu.Unlock()
+	if ok {
+		return t
+	}
+	// The names sort in time order, yyyymmdd rollups before that day's reports.
+	reports, _ := readDirRe(dir, reportName.String())
+	if len(reports) == 0 {
+		return time.Time{}
+	}
+	t, err := savedAt(reports[0].Name())
+	if err != nil {
+		return time.Time{}
+	}
+	poursMu.Lock()
+	firsts[dir] = t
+	poursMu.Unlock()
+	return t
+}
+
+// noteSaved updates the remembered first report of the series in dir with
+// one just written, as imports and rollups can sort before it.
+func noteSaved(dir, name string) {
+	t, err := savedAt(name)
+	if err != nil {
+		return
+	}
+	poursMu.Lock()
+	defer poursMu.Unlock()
+	if first, ok := firsts[dir]; ok && t.Before(first) {
+		firsts[dir] = t
+	}
+}
+
+// savedAt returns the time in a report's file name, which is in local time as
+// saveName writes it.
+func savedAt(name string) (time.Time, error) {
+	digits, _, _ := strings.Cut(name, ".")
+	if len(digits) > len("20060102150405") {
+		return time.Time{}, fmt.Errorf("not a report name: %s", name)
+	}
+	return time.ParseInLocation("20060102150405"[:len(digits)], digits, time.Local)
+}
+
+// PourStats summarizes a series' pours over a period.
+type PourStats struct {
+	Fridge        string
+	Since         time.Time
+	Count         int
+	PerDay        float64
+	AverageLitres float64
+	TotalLitres   float64
+	Pours         []Pour `json:",omitempty"`
+}
+
+// pourStats summarizes the pours of a series since a time. The pours per day
+// are over the part of the period the series has been reporting, counted as
+// at least a day.
+func pourStats(series string, since time.Time) (PourStats, error) {
+	poursMu.Lock()
+	ps, err := pourLog(series, since)
+	poursMu.Unlock()
+	st := PourStats{Fridge: series, Since: since, Pours: []Pour{}}
+	if err != nil {
+		return st, err
+	}
+	st.Pours = append(st.Pours, ps...)
+	for _, p := range ps {
+		st.TotalLitres += p.Litres
+	}
+	st.Count = len(st.Pours)
+	if st.Count > 0 {
+		st.AverageLitres = st.TotalLitres / float64(st.Count)
+	}
+	from := since
+	if first := firstReported(series); first.After(from) {
+		from = first
+	}
+	st.PerDay = float64(st.Count) / max(time.Since(from).Hours()/24, 1)
+	return st, nil
+}
+
+// fridgePours answers /pours/{fridge} with the pours of the last week, or of
+// the duration given by ?since=, as JSON.
+func fridgePours(w http.ResponseWriter, r *http.Request) {
+	series := strings.Trim(r.URL.Path, "/")
+	if !knownFridge(series) {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+	since, err := sinceParam(r, 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	st, err := pourStats(series, since)
+	if err != nil {
+		ctxLog(r.Context()).Error("Couldn't read the pour log", "fridge", series, "err", err)
+		http.Error(w, "Couldn't read the pour log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// validate checks the pour detection settings, calling fail for each problem.
+func (p PourConfig) validate(fail func(format string, a ...any)) {
+	if p.Noise <= 0 || p.Noise >= 1 {
+		fail("Pours.Noise: must be between 0 and 1, not %g", p.Noise)
+	}
+	if p.Settle < 2 {
+		fail("Pours.Settle: must be at least 2, not %d", p.Settle)
+	}
+	if p.MaxGap.Duration <= 0 {
+		fail("Pours.MaxGap: must be positive, not %s", p.MaxGap)
+	}
+	if p.MaxDuration.Duration <= 0 {
+		fail("Pours.MaxDuration: must be positive, not %s", p.MaxDuration)
+	}
+	if p.MinLitres <= 0 || p.MaxLitres <= p.MinLitres {
+		fail("Pours: MinLitres must be positive and less than MaxLitres")
+	}
+	if p.KegLitres <= 0 {
+		fail("Pours.KegLitres: must be positive, not %g", p.KegLitres)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawSeries returns one sample a second from at, with the given fill ratios.
+func rawSeries(at time.Time, fills ...float64) []Sample {
+	ss := make([]Sample, len(fills))
+	for i, f := range fills {
+		ss[i] = Sample{Timestamp: at.Add(time.Duration(i) * time.Second), RawFillRatio: f, PubFillRatio: f}
+	}
+	return ss
+}
+
+func TestPourDetector(t *testing.T) {
+	p := defaultConfig().Pours
+	at := time.Date(2024, 1, 2, 18, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		fills []float64
+		want  []float64 // litres
+	}{
+		{"pint", []float64{0.8, 0.801, 0.8, 0.8, 0.795, 0.788, 0.781, 0.776, 0.776, 0.7765, 0.776}, []float64{0.468}},
+		{"noise", []float64{0.5, 0.502, 0.499, 0.501, 0.5, 0.498, 0.5, 0.501}, nil},
+		{"bump", []float64{0.5, 0.5, 0.5, 0.2, 0.9, 0.5, 0.5, 0.5, 0.5}, nil},
+		{"keg lifted", []float64{0.5, 0.5, 0.5, 0, 0, 0, 0}, nil},
+		{"two pours", []float64{0.6, 0.6, 0.6, 0.58, 0.57, 0.57, 0.57, 0.57, 0.55, 0.54, 0.54, 0.54}, []float64{0.585, 0.585}},
+	} {
+		var d pourDetector
+		var got []float64
+		for _, s := range rawSeries(at, tc.fills...) {
+			if pour, found := d.add(s, p, p.KegLitres); found {
+				got = append(got, pour.Litres)
+				if !pour.End.After(pour.Start) {
+					t.Errorf("%s: pour ends before it starts: %+v", tc.name, pour)
+				}
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got pours %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-tc.want[i]) > 0.01 {
+				t.Errorf("%s: pour %d is %gL, want %gL", tc.name, i, got[i], tc.want[i])
+			}
+		}
+	}
+
+	// A gap in the samples means we can't tell what happened.
+	var d pourDetector
+	ss := rawSeries(at, 0.8, 0.8, 0.8, 0.78, 0.76, 0.76, 0.76)
+	for i := 4; i < len(ss); i++ {
+		ss[i].Timestamp = ss[i].Timestamp.Add(time.Minute)
+	}
+	for _, s := range ss {
+		if pour, found := d.add(s, p, p.KegLitres); found {
+			t.Errorf("pour found across a gap: %+v", pour)
+		}
+	}
+}
+
+func TestPours(t *testing.T) {
+	freshData(t)
+	t.Cleanup(func() {
+		poursMu.Lock()
+		clear(detectors)
+		clear(pourLogs)
+		clear(firsts)
+		poursMu.Unlock()
+	})
+	fridge := "Pourville"
+
+	at := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	raw := rawSeries(at, 0.8, 0.8, 0.8, 0.79, 0.78, 0.776, 0.776, 0.776)
+	for _, half := range [][]Sample{raw[:4], raw[4:]} { // a pour across two reports
+		rep := ICBMreport{FridgeName: fridge, RawSamples: half, StableSamples: half[len(half)-1:]}
+		if err := acceptReport(t.Context(), rep, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dataRoot, fridge, pourFile))
+	if err != nil || strings.Count(string(b), "\n") != 1 {
+		t.Fatalf("pour log: %v %q", err, b)
+	}
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/pours/" + fridge + "?since=24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st PourStats
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if st.Count != 1 || math.Abs(st.AverageLitres-0.468) > 0.01 || math.Abs(st.PerDay-1) > 0.01 || !st.Pours[0].Start.Equal(raw[2].Timestamp) {
+		t.Errorf("unexpected pour stats %+v", st)
+	}
+
+	resp, err = http.Get(srv.URL + "/b/" + fridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// The fridge started reporting an hour ago, so the week counts as a day.
+	if !strings.Contains(string(status), "pours-per-day: 1.0\n") || !strings.Contains(string(status), "average-pour: 0.47L\n") {
+		t.Errorf("/b/ doesn't show the pours: %s", status)
+	}
+
+	// Older pours are read from disk when asked for, not kept, and the pours
+	// per day are from the first report.
+	old := at.AddDate(0, 0, -20)
+	appendJSONLine(dataPath(fridge, pourFile), Pour{Start: old, End: old.Add(5 * time.Second), Litres: 0.5})
+	rep := (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: []Sample{{Timestamp: old, PubFillRatio: 0.8}}})
+	if _, _, err := rep.write(old.Local().Format("20060102150405"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := pourStats(fridge, at.AddDate(0, 0, -30)); err != nil || st.Count != 2 || math.Abs(st.PerDay-2/(20+1.0/24)) > 1e-3 {
+		t.Errorf("unexpected pour stats over a month: %v %+v", err, st)
+	}
+	poursMu.Lock()
+	defer poursMu.Unlock()
+	if c := pourLogs[filepath.Join(dataRoot, fridge, pourFile)]; c == nil || len(c.pours) != 1 {
+		t.Errorf("pours beyond %s kept in memory: %+v", poursCached, c)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+// Reloading the user database, templates and configuration while serving,
+// on SIGHUP or SIGUSR1, or a POST to /admin/reload.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// routes serves requests with the handler from Routes, rebuilt by reload as
+// the fridge pages and CORS origins come from the configuration.
+var routes swapHandler
+
+// swapHandler is an http.Handler which can be replaced while serving.
+type swapHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func (s *swapHandler) Store(h http.Handler) {
+	s.h.Store(&h)
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.h.Load()).ServeHTTP(w, r)
+}
+
+var reloading sync.Mutex // one reload at a time
+
+// reload re-reads .env, the config file, the templates and the user database.
+// Each is only replaced if the new version loads, otherwise the old one is
+// kept and the error returned. It returns a description of what changed.
+func reload() ([]string, error) {
+	reloading.Lock()
+	defer reloading.Unlock()
+	loadDotEnv()
+	var changes []string
+	var errs []error
+
+	old := conf()
+	c, err := readConfig(configFile())
+	if err != nil {
+		errs = append(errs, fmt.Errorf("config and templates: %w", err))
+	} else {
+		// Listeners and the data folder can't move while serving.
+		fixed := []struct {
+			name     string
+			from, to any
+			keep     func()
+		}{
+			{"HTTP", old.HTTP, c.HTTP, func() { c.HTTP = old.HTTP }},
+			{"HTTPS", old.HTTPS, c.HTTPS, func() { c.HTTPS = old.HTTPS }},
+			{"TLS", jsonString(old.TLS), jsonString(c.TLS), func() { c.TLS = old.TLS }},
+			{"DataRoot", old.DataRoot, c.DataRoot, func() { c.DataRoot = old.DataRoot }},
+			{"Metrics", old.Metrics, c.Metrics, func() { c.Metrics = old.Metrics }},
+			{"MQTT", jsonString(old.MQTT), jsonString(c.MQTT), func() { c.MQTT = old.MQTT }},
+		}
+		for _, f := range fixed {
+			if f.from != f.to {
+				changes = append(changes, fmt.Sprintf("config: %s changed, restart to apply", f.name))
+				f.keep()
+			}
+		}
+		t, _ := parseTemplates(c.Templates) // readConfig checked it parses
+		if fields := changedFields(*old, c); len(fields) > 0 {
+			changes = append(changes, "config: "+strings.Join(fields, ", ")+" changed")
+		}
+		changes = append(changes, fmt.Sprintf("templates: %d parsed", len(t.Templates())))
+
+		if jsonString(c.Log) != jsonString(old.Log) {
+			if err := setupLogging(c.Log); err != nil {
+				errs = append(errs, fmt.Errorf("log settings: %w", err))
+				c.Log = old.Log
+			}
+		}
+		templates.Store(t)
+		current.Store(&c)
+		if c.S3 != old.S3 {
+			var ar *Archive
+			if !c.S3.Disabled {
+				ar, err = newArchive(c.S3)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("S3 client: %w", err))
+				}
+			}
+			s3client.Store(ar)
+		}
+		routes.Store(Routes())
+	}
+
+	db, err := readUserList()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("user database: %w", err))
+	} else {
+		changes = append(changes, userChanges(userDB(), db)...)
+		users.Store(&db)
+		usersLoaded.Store(true)
+	}
+
+	for _, ch := range changes {
+		slog.Info("reload: " + ch)
+	}
+	for _, err := range errs {
+		slog.Error("reload: kept the old " + err.Error())
+	}
+	return changes, errors.Join(errs...)
+}
+
+// jsonString returns v as JSON, for comparing structs with slices in them.
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// changedFields lists the top level settings which differ between a and b.
+func changedFields(a, b Config) []string {
+	var am, bm map[string]json.RawMessage
+	json.Unmarshal([]byte(a.redacted()), &am)
+	json.Unmarshal([]byte(b.redacted()), &bm)
+	var fields []string
+	for k := range bm {
+		if jsonString(am[k]) != jsonString(bm[k]) {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// userChanges describes the difference between two user databases by
+// username, never mentioning API keys.
+func userChanges(from, to map[string]User) []string {
+	summarize := func(db map[string]User) map[string]User {
+		byName := map[string]User{}
+		for _, u := range db {
+			byName[u.Username] = u
+		}
+		return byName
+	}
+	a, b := summarize(from), summarize(to)
+	var changes []string
+	for name, u := range b {
+		old, found := a[name]
+		switch {
+		case !found:
+			changes = append(changes, "users: added "+name)
+		case old.Valid != u.Valid && u.Valid:
+			changes = append(changes, "users: enabled "+name)
+		case old.Valid != u.Valid:
+			changes = append(changes, "users: disabled "+name)
+		case old.Admin != u.Admin:
+			changes = append(changes, "users: changed admin rights for "+name)
+		}
+	}
+	for name := range a {
+		if _, found := b[name]; !found {
+			changes = append(changes, "users: removed "+name)
+		}
+	}
+	if len(from) != len(to) || len(changes) > 0 {
+		changes = append(changes, fmt.Sprintf("users: %d API keys loaded", len(to)))
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// requireAdmin returns the user for an admin API key, or writes an error
+// response and returns nil.
+func requireAdmin(w http.ResponseWriter, r *http.Request) *User {
+	user := getLogin(w, r)
+	if user == nil {
+		http.Error(w, "Please supply an authorized API key", http.StatusUnauthorized)
+		return nil
+	}
+	if !user.Admin {
+		http.Error(w, "This needs an administrator's API key", http.StatusForbidden)
+		return nil
+	}
+	return user
+}
+
+// isAdmin reports whether a request carries an enabled admin's API key,
+// without counting it as a login, for pages which only show admins more.
+func isAdmin(r *http.Request) bool {
+	u, found := userDB()[r.Header.Get("x-icbm-api-key")]
+	return found && u.Valid && u.Admin
+}
+
+// adminReload handles POST /admin/reload.
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Please POST to reload", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	changes, err := reload()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "kept the old %s\n", err)
+	}
+	for _, ch := range changes {
+		io.WriteString(w, ch+"\n")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keepLive restores the reloadable state, the data folder and the series in
+// memory when the test is done.
+func keepLive(t *testing.T) {
+	c, tm, db, root := conf(), templates.Load(), users.Load(), dataRoot
+	tapReportMu.Lock()
+	series := maps.Clone(tapReport)
+	tapReportMu.Unlock()
+	t.Cleanup(func() {
+		current.Store(c)
+		templates.Store(tm)
+		users.Store(db)
+		dataRoot = root
+		tapReportMu.Lock()
+		tapReport = series
+		tapReportMu.Unlock()
+		// The event streams follow the reports.
+		streamsMu.Lock()
+		clear(streams)
+		streamsMu.Unlock()
+	})
+}
+
+// freshData is keepLive for tests which store reports. They start with an
+// empty data folder, and an admin and a user with the API keys "admin" and
+// "user".
+func freshData(t *testing.T) {
+	keepLive(t)
+	dataRoot = t.TempDir()
+	users.Store(&map[string]User{"admin": {Username: "root", Valid: true, Admin: true}, "user": {Username: "fridge", Valid: true}})
+}
+
+func TestReload(t *testing.T) {
+	keepLive(t)
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "icbm.json")
+	os.WriteFile(filepath.Join(dir, "Lunarville.tmpl"), []byte("custom {{.Title}}"), 0600)
+	os.WriteFile(fn, []byte(`{"ChartLines": 50, "HTTP": ":9999", "Templates": "`+dir+`", "S3": {"Disabled": true}}`), 0600)
+	t.Setenv("ICBMConfig", fn)
+	t.Setenv("ICBMUserDb", `{"key1": {"Username": "fridge", "Valid": true}}`)
+
+	changes, err := reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(changes, "\n")
+	for _, want := range []string{"HTTP changed, restart to apply", "ChartLines", "users: added fridge"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("changes %q don't mention %q", all, want)
+		}
+	}
+	if conf().ChartLines != 50 || conf().HTTP == ":9999" {
+		t.Errorf("unexpected config after reload: %+v", conf())
+	}
+	if page := renderPageText(t, "Lunarville"); !strings.HasPrefix(page, "custom") {
+		t.Error("template not reloaded:", page)
+	}
+	if _, found := userDB()["key1"]; !found {
+		t.Error("user database not reloaded")
+	}
+
+	// Broken files keep what was there.
+	os.WriteFile(fn, []byte(`{"ChartLines": `), 0600)
+	t.Setenv("ICBMUserDb", `{"key2": `)
+	if _, err := reload(); err == nil {
+		t.Fatal("expected errors from a broken config and user database")
+	}
+	if conf().ChartLines != 50 {
+		t.Error("broken config replaced the old one")
+	}
+	if _, found := userDB()["key1"]; !found {
+		t.Error("broken user database replaced the old one")
+	}
+}
+
+// renderPageText renders the named fridge's template directly, bypassing the
+// need for any samples.
+func renderPageText(t *testing.T, fridge string) string {
+	var b strings.Builder
+	if err := templates.Load().ExecuteTemplate(&b, fridge+".tmpl", struct{ Title string }{fridge}); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestAdminReload(t *testing.T) {
+	keepLive(t)
+	db := map[string]User{"admin": {Username: "root", Valid: true, Admin: true}, "user": {Username: "fridge", Valid: true}}
+	users.Store(&db)
+	t.Setenv("ICBMUserDb", `{"admin": {"Username": "root", "Valid": true, "Admin": true}}`)
+
+	for _, tr := range []struct {
+		method, key string
+		code        int
+	}{
+		{"GET", "admin", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "user", http.StatusForbidden},
+		{"POST", "admin", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tr.method, "/admin/reload", nil)
+		req.Header.Set("X-Icbm-Api-Key", tr.key)
+		w := httptest.NewRecorder()
+		adminReload(w, req)
+		if w.Code != tr.code {
+			t.Errorf("%s with key %q: got %d, expected %d: %s", tr.method, tr.key, w.Code, tr.code, w.Body)
+		}
+	}
+	if _, found := userDB()["user"]; found {
+		t.Error("reload through the endpoint didn't replace the user database")
+	}
+}
@@ -6,32 +6,46 @@
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
-	"strings"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	tmpl *template.Template
-)
+// templates holds the parsed page templates, replaced wholesale by reload.
+var templates atomic.Pointer[template.Template]
 
 func init() {
-	tmpl = template.Must(template.ParseFS(AssetFS, "template/*.tmpl"))
+	templates.Store(template.Must(parseTemplates("")))
+}
+
+// parseTemplates parses the built-in templates, then any in dir, which
+// replace built-in ones of the same name.
+func parseTemplates(dir string) (*template.Template, error) {
+	t, err := template.ParseFS(AssetFS, "template/*.tmpl")
+	if err != nil || dir == "" {
+		return t, err
+	}
+	if ff, _ := filepath.Glob(filepath.Join(dir, "*.tmpl")); len(ff) == 0 {
+		return nil, fmt.Errorf("no .tmpl files in %s", dir)
+	}
+	return t.ParseGlob(filepath.Join(dir, "*.tmpl"))
 }
 
-// BeverageStatus takes a fridge name and returns an httpHandleFunc which
+// BeverageStatus takes a fridge and returns an httpHandleFunc which
 // renders the page for that fridge.
-func BeverageStatus(endpoint string) func(http.ResponseWriter, *http.Request) {
+func BeverageStatus(f FridgeConfig) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, renderPage(endpoint))
+		io.WriteString(w, renderPage(f, f.Name))
 	}
 }
 
-// renderPage takes a template corresponding to the fridge name and renders out
-// the most recent data.
-func renderPage(fridge string) string {
+// renderPage renders the fridge's template with the most recent data of
+// series, which is the fridge itself or one of its taps.
+func renderPage(f FridgeConfig, series string) string {
+	fridge := series
 	data := struct {
 		Title       string
 		Items       []string
@@ -39,54 +53,53 @@ func renderPage(fridge string) string {
 		FillPercent float64
 		Report      *ICBMreport
 		LastTime    time.Time
+		Events      string // path of the fridge's live updates
+		Catalog     string // path of the fridge's beverage catalog
+		StaleAfter  int64  // milliseconds without a sample before the page shows as stale
+		Channels    []ChannelSummary
+		Beverage    *Beverage // what's on, if anyone has said
 	}{}
 	data.Title = fridge + " status"
-	data.Report = tapReport[fridge]
+	data.Events = "/events/" + fridge
+	data.Catalog = "/beverages/" + fridge
+	data.StaleAfter = conf().Events.StaleAfter.Milliseconds()
+	data.Report = seriesReport(fridge)
 
 	if data.Report == nil {
 		return "Not found!" // make a 404 page
 	}
-	count := len(tapReport[fridge].StableSamples)
-	s := tapReport[fridge].StableSamples[count-1]
+	s, ok := data.Report.latest()
+	if !ok {
+		return "Not found!"
+	}
 	data.FillPercent = s.PubFillRatio
 	data.LastTime = s.Timestamp
+	data.Channels = channelSummaries(fridge, time.Time{})
+	data.Beverage = onTap(fridge)
 
-	maxCount := int(maxAge / (300 * time.Second))
-	fracMissing := 1.0 - float64(count)/float64(maxCount)
+	// A bubble pops for each twelfth of the history in memory missing, as on
+	// /uptime, counted from the first report of a new fridge.
+	now := time.Now()
+	first := firstReported(fridge)
+	data.Report.mu.Lock()
+	data.Report.sort()
+	count := len(data.Report.StableSamples)
+	up := uptimeSince(data.Report.StableSamples, first, "", now.Add(-conf().MaxAge.Duration), now)
+	data.Report.mu.Unlock()
+	fracMissing := 1 - up.Percent/100
 	data.Pop = int(math.Floor(12.0 * fracMissing))
 	data.Pop = clamp(data.Pop, 0, 12)
-	log.Println(fracMissing, data.Pop, count, maxCount)
+	slog.Debug("Rendering page", "fridge", fridge, "missing", fracMissing, "pop", data.Pop, "samples", count, "gaps", up.Gaps)
 
 	var res bytes.Buffer
-	err := tmpl.ExecuteTemplate(&res, fridge+".tmpl", data)
+	err := templates.Load().ExecuteTemplate(&res, f.template(), data)
 	if err != nil {
-		log.Println("Could not execute template:", err)
+		slog.Error("Could not execute template", "template", f.template(), "err", err)
 	}
 	return res.String()
 }
 
-func tapStatus(w http.ResponseWriter, r *http.Request) {
-	path := strings.Split(r.URL.Path, "/")
-	fridge := path[0]
-	t, found := tapReport[fridge]
-	if !found || t == nil {
-		http.NotFound(w, r)
-		return
-	}
-
-	// emit stats from the report
-	ss := mapf(t.StableSamples, func(s []Sample, i int) float64 { return s[i].PubFillRatio })
-	ts := mapf(t.StableSamples, func(s []Sample, i int) time.Time { return s[i].Timestamp })
-	fmt.Fprintf(w, "average: %0.3g ± %0.3g%%\n", average(ss)*100, stdev(ss)*100)
-	if len(ts) > 1 {
-		span := ts[len(ts)-1].Sub(ts[0])
-		days := int(span.Hours() / 24)
-		hours := int(math.Mod(span.Hours(), 24))
-		mins := int(math.Mod(span.Minutes(), 60))
-		fmt.Fprintf(w, "cached-range: %dd%dh%dm\n", days, hours, mins)
-	}
-}
-
 func icbmVersion(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, platform())
+	io.WriteString(w, "\nconfig: "+conf().redacted()+"\n")
 }
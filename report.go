@@ -5,19 +5,24 @@
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime/debug"
 
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"maps"
 	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/constraints"
@@ -30,6 +35,10 @@
 		RawFillRatio float64
 		RawMass      int
 		Timestamp    time.Time
+
+		// Readings holds the other sensors' values by channel name, eg
+		// temperature, door (1 for open) or humidity.
+		Readings map[string]float64 `json:",omitempty"`
 	}
 	// ICBMreport corresponds to the fridge payload.
 	ICBMreport struct {
@@ -39,14 +48,42 @@
 		RawSamples    []Sample // every second or two
 		StableSamples []Sample // every minute
 
+		// Units names the unit of each channel in the samples' Readings.
+		Units map[string]string `json:",omitempty"`
+
+		// Taps carries the scales of a fridge with several kegs. Each is
+		// stored and charted as a fridge of its own, see tapSeries.
+		Taps []TapReport `json:",omitempty"`
+
+		// ClockFix is set on reports whose timestamps were corrected for
+		// the fridge's clock being wrong.
+		ClockFix *ClockFix `json:",omitempty"`
+
+		// TapOf is set on a tap's reports, naming the fridge it's a tap of.
+		TapOf string `json:",omitempty"`
+
 		sorted bool
 		mu     *sync.Mutex
 	}
+	// TapReport is one scale's calibration and samples in a multi-tap report.
+	TapReport struct {
+		Name          string
+		RawMassFull   int
+		RawMassTare   int
+		RawSamples    []Sample
+		StableSamples []Sample
+		Units         map[string]string `json:",omitempty"`
+	}
 )
 
 // Append samples from the passed report to this one.
 func (r *ICBMreport) Append(n ICBMreport) *ICBMreport {
 	if r == nil {
+		if n.mu == nil {
+			n.mu = &sync.Mutex{}
+		}
+		n.ClockFix = nil // it's only true of the one report
+		n.Units = maps.Clone(n.Units)
 		return &n
 	}
 	r.mu.Lock()
@@ -54,10 +91,49 @@ func (r *ICBMreport) Append(n ICBMreport) *ICBMreport {
 
 	r.RawSamples = append(r.RawSamples, n.RawSamples...)
 	r.StableSamples = append(r.StableSamples, n.StableSamples...)
+	if n.RawMassFull != 0 || n.RawMassTare != 0 {
+		r.RawMassFull, r.RawMassTare = n.RawMassFull, n.RawMassTare // the latest calibration
+	}
+	for ch, unit := range n.Units {
+		if r.Units == nil {
+			r.Units = map[string]string{}
+		}
+		r.Units[ch] = unit
+	}
+	if n.TapOf != "" {
+		r.TapOf = n.TapOf
+	}
 	r.sorted = false
 	return r
 }
 
+// latest returns the newest stable sample in the report, if it has any.
+func (r *ICBMreport) latest() (Sample, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sort()
+	if len(r.StableSamples) == 0 {
+		return Sample{}, false
+	}
+	return r.StableSamples[len(r.StableSamples)-1], true
+}
+
+// latestBefore returns the newest stable sample in the report from before t,
+// if it has one.
+func (r *ICBMreport) latestBefore(t time.Time) (Sample, bool) {
+	if r == nil {
+		return Sample{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sort()
+	i := sort.Search(len(r.StableSamples), func(i int) bool { return !r.StableSamples[i].Timestamp.Before(t) })
+	if i == 0 {
+		return Sample{}, false
+	}
+	return r.StableSamples[i-1], true
+}
+
 // sort the samples in this report by time. Requires the caller to hold the lock.
 func (r *ICBMreport) sort() {
 	if r == nil || r.sorted {
@@ -73,11 +149,54 @@ func (r *ICBMreport) sort() {
 	r.sorted = true
 }
 
-// Save a compressed (.json.gz) version of this report to dataPath(fn) + .json.gz.
-func (r *ICBMreport) Save(fn, comment string) {
+// Save a compressed (.json.gz) version of this report to dataPath(fn) + .json.gz,
+// and upload a copy to the archive in the background. Log lines carry ctx's
+// request ID, if any.
+func (r *ICBMreport) Save(ctx context.Context, fn, comment string) {
 	if r == nil {
 		return
 	}
+	fn, zdata, err := r.write(fn, comment)
+	saved(ctx, fn, zdata, err)
+}
+
+// SaveAsSent stores a report exactly as the fridge gzipped it, as Save
+// would, to dataPath(fridge, fn.json.gz).
+func SaveAsSent(ctx context.Context, fridge, fn string, gz []byte) {
+	fn = dataPath(fridge, fmt.Sprintf("%s.json.gz", fn))
+	err := ioutil.WriteFile(fn, gz, 0644)
+	if err != nil {
+		err = fmt.Errorf("error writing %s: %w", fn, err)
+	}
+	saved(ctx, fn, gz, err)
+}
+
+// saved logs how writing fn went, then uploads zdata to the archive in the
+// background.
+func saved(ctx context.Context, fn string, zdata []byte, err error) {
+	lg := ctxLog(ctx)
+	if err != nil {
+		lg.Error("Couldn't save report", "err", err)
+	} else {
+		lg.Debug("Saved report", "file", fn, "bytes", len(zdata))
+	}
+	ar := s3client.Load()
+	background(func() {
+		err := ar.Put(fn, zdata)
+		switch {
+		case err == errUninitialized:
+		case err != nil:
+			count("upload_errors")
+			lg.Error("Couldn't upload report", "file", fn, "err", err)
+		default:
+			lg.Debug("Uploaded report", "file", fn)
+		}
+	})
+}
+
+// write the compressed report to dataPath(fridge, fn.json.gz) and return the
+// path and the bytes written.
+func (r *ICBMreport) write(fn, comment string) (string, []byte, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.sort()
@@ -93,19 +212,35 @@ func (r *ICBMreport) Save(fn, comment string) {
 	zw.Comment = comment
 	zw.ModTime = time.Now()
 	if _, err := zw.Write(data); err != nil {
-		log.Printf("error compressing %s: %v", fn, err)
+		slog.Error("Couldn't compress report", "file", fn, "err", err)
 	}
 	zw.Close()
 
-	err := ioutil.WriteFile(fn, zdata.Bytes(), 0644)
-	if err != nil {
-		log.Printf("error writing %s: %v", fn, err)
+	if err := ioutil.WriteFile(fn, zdata.Bytes(), 0644); err != nil {
+		return fn, zdata.Bytes(), fmt.Errorf("error writing %s: %w", fn, err)
 	}
+	noteSaved(filepath.Dir(fn), filepath.Base(fn))
+	return fn, zdata.Bytes(), nil
+}
 
-	err = s3client.Put(fn, zdata.Bytes())
-	if err != nil && err != errUninitialized {
-		log.Printf("error uploading %s: %v", fn, err)
+// dedupe drops samples which repeat an earlier timestamp, returning how many
+// were removed. Requires the caller to hold the lock.
+func (r *ICBMreport) dedupe() int {
+	r.sort()
+	uniq := func(ss []Sample) []Sample {
+		kept := ss[:0]
+		for i := range ss {
+			if i > 0 && ss[i].Timestamp.Equal(kept[len(kept)-1].Timestamp) {
+				continue
+			}
+			kept = append(kept, ss[i])
+		}
+		return kept
 	}
+	n := len(r.RawSamples) + len(r.StableSamples)
+	r.RawSamples = uniq(r.RawSamples)
+	r.StableSamples = uniq(r.StableSamples)
+	return n - len(r.RawSamples) - len(r.StableSamples)
 }
 
 // Trim the Samples to the latest max count.
@@ -187,31 +322,35 @@ func clamp[T constraints.Ordered](x, low, high T) T {
 }
 
 // processUpdate takes a set of samples and appends them to the correct history
-func processUpdate(u ICBMreport) error {
+func processUpdate(ctx context.Context, u ICBMreport) error {
 	filename := dataPath(u.FridgeName + ".tsv")
 	chartData := ""
 	for _, s := range u.StableSamples {
 		s.PubFillRatio = clamp(s.PubFillRatio, 0.0, 1.0)
 		chartData += fmt.Sprintf("%d\t%g\n", s.Timestamp.Unix(), s.PubFillRatio)
-		// metrics.DataPoints++
 	}
+	countN("data_points", len(u.StableSamples))
+	ctxLog(ctx).Debug("Processing update", "fridge", u.FridgeName, "stable", len(u.StableSamples), "raw", len(u.RawSamples))
+	forgetDrinking(u.FridgeName, u.StableSamples)
+	tapReportMu.Lock()
 	tapReport[u.FridgeName] = tapReport[u.FridgeName].Append(u)
-	tapReport[u.FridgeName].KeepSince(maxAge)
-
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		// metrics.Errors++
-		return fmt.Errorf("could not open data file for appending: %w", err)
+	tapReport[u.FridgeName].KeepSince(conf().MaxAge.Duration)
+	tapReportMu.Unlock()
+	refills := publishReport(u)
+	for _, rf := range refills {
+		closeOutKeg(u.FridgeName, rf.Timestamp)
 	}
-	if _, err := f.Write([]byte(chartData)); err != nil {
-		// metrics.Errors++
-		return fmt.Errorf("could not append chartdata: %w", err)
+	if err := recordRefills(u.FridgeName, refills); err != nil {
+		ctxLog(ctx).Error("Couldn't record refills", "fridge", u.FridgeName, "err", err)
 	}
-	if err := f.Close(); err != nil {
-		// metrics.Errors++
-		return fmt.Errorf("could not close written file: %w", err)
+	checkAlerts(u)
+	detectPours(u)
+	checkAnomalies(u)
+
+	if err := appendChart(filename, chartData); err != nil {
+		return err
 	}
-	return trimFile(filename, 10000)
+	return chartChannels(u)
 }
 
 var disallowed = regexp.MustCompile(`[^[:alnum:]-.]`)
@@ -227,6 +366,13 @@ func icbmUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Please send a request body", http.StatusBadRequest)
 		return
 	}
+	ctx := r.Context()
+	lim := conf().Limits
+	if ok, wait := ipLimits.allow(clientIP(r), lim.IPPerMinute, lim.IPBurst, time.Now()); !ok {
+		rejectReport(ctx, "", userDB()[r.Header.Get("x-icbm-api-key")].Username, http.StatusTooManyRequests, "rate limited by address")
+		tooMany(w, wait)
+		return
+	}
 	user := getLogin(w, r)
 	if user == nil {
 		http.Error(w, "Fridge status not updated, please supply an authorized API key", http.StatusUnauthorized)
@@ -236,24 +382,120 @@ func icbmUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Your account is disabled, please contact the administrator if you believe this is in error", http.StatusForbidden)
 		return
 	}
-	var data ICBMreport
-	rawRequest, _ := ioutil.ReadAll(r.Body)
-	if err := json.NewDecoder(bytes.NewReader(rawRequest)).Decode(&data); err != nil {
-		// metrics.BadJSON++
+	if ok, wait := keyLimits.allow(r.Header.Get("x-icbm-api-key"), lim.KeyPerMinute, lim.KeyBurst, time.Now()); !ok {
+		rejectReport(ctx, "", user.Username, http.StatusTooManyRequests, "rate limited by key")
+		tooMany(w, wait)
+		return
+	}
+	rawRequest, gz, err := decodeBody(w, r)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		rejectReport(ctx, "", user.Username, http.StatusRequestEntityTooLarge, err.Error())
+		tooLarge(w, err.Error())
+		return
+	case errors.Is(err, errUnsupportedEncoding):
+		rejectReport(ctx, "", user.Username, http.StatusUnsupportedMediaType, err.Error())
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		rejectReport(ctx, "", user.Username, http.StatusBadRequest, err.Error())
+		http.Error(w, "Couldn't read the report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, verbatim, err := decodeReport(r.Header.Get("Content-Type"), rawRequest)
+	if err != nil {
+		count("bad_json")
+		rejectReport(ctx, data.FridgeName, user.Username, http.StatusBadRequest, err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	data.FridgeName = sanitize(data.FridgeName)
-	data.mu = &sync.Mutex{}
+	if !verbatim {
+		gz = nil // what was sent isn't what we store
+	}
+	switch err := acceptReport(ctx, data, gz); {
+	case errors.Is(err, errTooManySamples):
+		rejectReport(ctx, data.FridgeName, user.Username, http.StatusRequestEntityTooLarge, err.Error())
+		tooLarge(w, err.Error())
+		return
+	case err != nil:
+		rejectReport(ctx, data.FridgeName, user.Username, http.StatusBadRequest, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	io.WriteString(w, fmt.Sprintf("Fridge status updated for %s, thank you %s\n", sanitize(data.FridgeName), user.Username))
+}
+
+var errTooManySamples = errors.New("too many samples")
+
+// rejectReport logs a report turned away with status code as a warning about
+// the fridge it names or, if it can't be read, the one user last reported
+// for, so it shows in that fridge's diagnostics.
+func rejectReport(ctx context.Context, fridge, user string, code int, why string) {
+	fridge = sanitize(fridge)
+	if fridge == "" && user != "" {
+		fridge = reportedBy(user)
+	}
+	lg := ctxLog(ctx)
+	if fridge != "" {
+		lg = lg.With("fridge", fridge)
+	}
+	lg.Warn("Rejected report", "status", code, "err", why)
+}
+
+// lastSaved is the time, in Unix nanoseconds, of the last report named by
+// saveName.
+var lastSaved atomic.Int64
+
+// saveName returns the file name, without .json.gz, to save a report received
+// at t under: its time to the nanosecond, and a nanosecond later than the
+// last if that's taken, so no two reports overwrite each other.
+func saveName(t time.Time) string {
+	for {
+		last := lastSaved.Load()
+		n := max(t.UnixNano(), last+1)
+		if lastSaved.CompareAndSwap(last, n) {
+			return time.Unix(0, n).In(t.Location()).Format("20060102150405.000000000")
+		}
+	}
+}
 
-	if err := processUpdate(data); err != nil {
-		log.Println("Error processing update:", err)
-		// metrics.Errors++
-		// Fallthrough to save the data regardless.
+// acceptReport checks a report against the limits, adds it to the fridge's
+// history and saves it, however it arrived. gz, if set, is the report as the
+// fridge gzipped it, stored as is if nothing needed changing.
+func acceptReport(ctx context.Context, data ICBMreport, gz []byte) error {
+	n := len(data.RawSamples) + len(data.StableSamples)
+	for _, t := range data.Taps {
+		n += len(t.RawSamples) + len(t.StableSamples)
+	}
+	if max := conf().Limits.MaxSamples; n > max {
+		return fmt.Errorf("%w: %d, the limit is %d", errTooManySamples, n, max)
+	}
+	sentName := data.FridgeName
+	data.FridgeName = sanitize(data.FridgeName)
+	if err := data.claimSeries(); err != nil {
+		return err
 	}
-	filename := time.Now().Format("20060102150405")
-	data.Save(filename, "icbm update for "+data.FridgeName)
-	io.WriteString(w, fmt.Sprintf("Fridge status updated for %s, thank you %s\n", data.FridgeName, user.Username))
+	dropped := dropBadChannels(ctx, &data)
+	received := time.Now()
+	corrected := checkClock(ctx, &data, received)
+	asSent := gz != nil && !dropped && !corrected && len(data.Taps) == 0 && storedAsSent(&data, sentName)
+	reqInfo(ctx).Fridge = data.FridgeName
+
+	filename := saveName(received)
+	for _, rep := range data.split() {
+		noteReport(rep.FridgeName, reqInfo(ctx).User, received)
+		if err := processUpdate(ctx, rep); err != nil {
+			count("update_errors")
+			ctxLog(ctx).Error("Error processing update", "fridge", rep.FridgeName, "err", err)
+			// Fallthrough to save the data regardless.
+		}
+		if asSent {
+			SaveAsSent(ctx, rep.FridgeName, filename, gz)
+		} else {
+			rep.Save(ctx, filename, "icbm update for "+rep.FridgeName)
+		}
+	}
+	return nil
 }
 
 // trimFile preserves the last N lines of contents of filename, removing all before.
@@ -262,11 +504,8 @@ func trimFile(filename string, n int) error {
 	if err != nil {
 		return err
 	}
-	tmpDir := "."
-	if superfly() {
-		tmpDir = "/data"
-	}
-	tmpfile, err := ioutil.TempFile(tmpDir, "icbm-data-")
+	// Keep the tempfile on the same filesystem so the rename is atomic.
+	tmpfile, err := ioutil.TempFile(filepath.Dir(filename), "icbm-data-")
 	if err != nil {
 		return fmt.Errorf("could not create tempfile from filename %s: %w", filename, err)
 	}
@@ -354,7 +593,7 @@ func average[T constraints.Float | constraints.Integer](slice []T) float64 {
 func buildInfo() string {
 	bi, ok := debug.ReadBuildInfo()
 	if !ok {
-		log.Println("Could not read build info")
+		slog.Warn("Could not read build info")
 		return ""
 	}
 
@@ -3,17 +3,21 @@
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -94,41 +98,74 @@ func noCache(h http.Handler) http.Handler {
 	})
 }
 
-var willServeFor = []string{
-	"http://lunarville.org",
-	"http://www.lunarville.org",
-	"https://lunarville.org",
-	"https://www.lunarville.org",
-	"https://api.evq.io",
-	"https://icbm.api.evq.io",
-	"http://localhost:*",
-	"https://icbm.fly.dev",
-}
-
 // Routes returns the mappings for handling web requests.
 func Routes() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/", assetSrv("static"))
 	// mux.HandleFunc("/", BeverageStatus("Lunarville"))
 	mux.Handle("/b/", http.StripPrefix("/b/", http.HandlerFunc(tapStatus)))
-	mux.HandleFunc("/bev", BeverageStatus("Lunarville"))
-	mux.HandleFunc("/bevbeta", BeverageStatus("Lunarville-beta"))
+	for _, f := range conf().Fridges {
+		mux.HandleFunc(f.Page, BeverageStatus(f))
+	}
+	mux.Handle("/tap/", http.StripPrefix("/tap/", http.HandlerFunc(tapPage)))
+	mux.Handle("/fridge/", http.StripPrefix("/fridge/", cors(http.HandlerFunc(fridgeOverview), conf().CORSOrigins...)))
+	mux.Handle("/channels/", http.StripPrefix("/channels/", cors(http.HandlerFunc(fridgeChannels), conf().CORSOrigins...)))
+	mux.Handle("/beverages/", http.StripPrefix("/beverages/", cors(http.HandlerFunc(beverages), conf().CORSOrigins...)))
+	mux.Handle("/admin/beverages/", http.StripPrefix("/admin/beverages/", http.HandlerFunc(adminBeverages)))
+	mux.Handle("/pours/", http.StripPrefix("/pours/", cors(http.HandlerFunc(fridgePours), conf().CORSOrigins...)))
+	mux.Handle("/heatmap/", http.StripPrefix("/heatmap/", cors(http.HandlerFunc(fridgeHeatmap), conf().CORSOrigins...)))
+	mux.Handle("/uptime/", http.StripPrefix("/uptime/", cors(http.HandlerFunc(fridgeUptime), conf().CORSOrigins...)))
+	mux.Handle("/clock/", http.StripPrefix("/clock/", cors(http.HandlerFunc(fridgeClock), conf().CORSOrigins...)))
+	mux.Handle("/ledger/", http.StripPrefix("/ledger/", cors(http.HandlerFunc(fridgeLedger), conf().CORSOrigins...)))
+	mux.Handle("/admin/ledger/", http.StripPrefix("/admin/ledger/", http.HandlerFunc(adminLedger)))
 	mux.HandleFunc("/icbm/v1", icbmUpdate)
-	mux.Handle("/data/", http.StripPrefix("/data/", cors(fileSrv("/data"), willServeFor...)))
+	mux.Handle("/events/", http.StripPrefix("/events/", cors(http.HandlerFunc(fridgeEvents), conf().CORSOrigins...)))
+	mux.Handle("/data/", http.StripPrefix("/data/", cors(fileSrv(conf().DataRoot), conf().CORSOrigins...)))
 	mux.Handle("/static/", http.StripPrefix("/static/", assetSrv("static")))
 	mux.HandleFunc("/version", icbmVersion)
+	mux.Handle("/healthz", noCache(http.HandlerFunc(healthz)))
+	mux.Handle("/readyz", noCache(http.HandlerFunc(readyz)))
+	mux.Handle("/readyz/local", noCache(http.HandlerFunc(readyzLocal)))
+	mux.HandleFunc("/admin/reload", adminReload)
 	return mux
 }
 
 func serve(httpaddr string) *http.Server {
-	logger := log.New(FilteredHTTPLogger(os.Stderr), "", log.LstdFlags)
+	return startServer(httpaddr, Routes(), nil)
+}
+
+// startServer serves h on addr in the background, over TLS if tc is set.
+func startServer(addr string, h http.Handler, tc *tls.Config) *http.Server {
+	logger := log.New(FilteredHTTPLogger(slogWriter{slog.LevelWarn}), "", 0)
+	lim := conf().Limits
 	srv := &http.Server{
-		Addr:     httpaddr,
-		ErrorLog: logger,
-		Handler:  Routes(),
+		Addr:      addr,
+		ErrorLog:  logger,
+		Handler:   logRequests(h),
+		TLSConfig: tc,
+
+		ReadHeaderTimeout: lim.ReadHeaderTimeout.Duration,
+		ReadTimeout:       lim.ReadTimeout.Duration,
+		WriteTimeout:      lim.WriteTimeout.Duration,
+		IdleTimeout:       lim.IdleTimeout.Duration,
+	}
+	// Cancel request contexts on shutdown, so event streams end rather than
+	// holding it up.
+	base, cancel := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context { return base }
+	srv.RegisterOnShutdown(cancel)
+
+	// Bind before returning so the caller can rely on the server accepting connections.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Print(err)
+		return srv
+	}
+	if tc != nil {
+		ln = tls.NewListener(ln, tc)
 	}
 	startHTTP := func(srv *http.Server) {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
 			logger.Print(err)
 		}
 	}
@@ -136,22 +173,71 @@ func serve(httpaddr string) *http.Server {
 	return srv
 }
 
+// processSignals blocks until we're asked to stop with SIGINT or SIGTERM,
+// reloading the configuration on SIGHUP or SIGUSR1.
 func processSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGUSR1)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	for {
 		sig := <-c
-		if sig == syscall.SIGINT {
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM:
+			slog.Info("Shutting down", "signal", sig)
 			return
+		case syscall.SIGHUP, syscall.SIGUSR1:
+			slog.Info("Reloading", "signal", sig)
+			reload()
 		}
 	}
 }
 
-func shutdown(srv *http.Server) {
-	// Attempt a graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// shutdown stops accepting connections, waits for requests in flight to
+// finish, then waits for background jobs such as archive uploads, giving up
+// after conf().ShutdownTimeout.
+func shutdown(servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf().ShutdownTimeout.Duration)
 	defer cancel()
-	go srv.Shutdown(ctx)
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("Shutting down", "addr", srv.Addr, "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if err := drain(ctx); err != nil {
+		slog.Warn("Gave up waiting for background jobs", "err", err)
+	}
+}
+
+// jobs tracks background work which must finish before the process exits.
+var jobs sync.WaitGroup
+
+// background runs f in its own goroutine, tracked by jobs.
+func background(f func()) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		f()
+	}()
+}
+
+// drain waits for background jobs to finish, or ctx to be done.
+func drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // superfly returns whether we're running on a fly.io instance.
@@ -168,7 +254,7 @@ func platform() string {
 		regions, _ := net.LookupTXT("regions.icbm.internal")
 		siblings, _ := net.LookupTXT("_apps.internal")
 		x += fmt.Sprintf("host:     %s.fly.dev\n", os.Getenv("FLY_APP_NAME"))
-		x += fmt.Sprintf("listen:   %s\n", *httpaddr)
+		x += fmt.Sprintf("listen:   %s %s\n", conf().HTTP, conf().HTTPS)
 		x += fmt.Sprintf("id:       %s\n", os.Getenv("FLY_ALLOC_ID"))
 		x += fmt.Sprintf("region:   %s\n", os.Getenv("FLY_REGION"))
 		x += fmt.Sprintf("peers:    %s\n", peers)
@@ -177,19 +263,20 @@ func platform() string {
 		return x
 	}
 	hostname, _ := os.Hostname()
-	return fmt.Sprintf("%s, %s\n", hostname, *httpaddr)
+	return fmt.Sprintf("%s, %s %s\n", hostname, conf().HTTP, conf().HTTPS)
 }
 
 // getLogin looks for a validated API key and returns the credentials
 // or nil on failure.
 func getLogin(w http.ResponseWriter, r *http.Request) *User {
 	apikey := r.Header.Get("x-icbm-api-key")
-	creds, found := users[apikey]
+	creds, found := userDB()[apikey]
 	if !found || !creds.Valid {
-		// metrics.BadLogins++
+		count("bad_logins")
 		return nil
 	}
-	// metrics.APILogins++
+	count("api_logins")
+	reqInfo(r.Context()).User = creds.Username
 	return &creds
 }
 
@@ -197,9 +284,20 @@ func getLogin(w http.ResponseWriter, r *http.Request) *User {
 type User struct {
 	Username string
 	Valid    bool
+	Admin    bool `json:",omitempty"` // may use the /admin/ endpoints
+}
+
+// users holds the user database, keyed by API key, replaced wholesale by reload.
+var users atomic.Pointer[map[string]User]
+
+func init() {
+	users.Store(&map[string]User{})
 }
 
-var users = map[string]User{} // The key is the API key.
+// userDB returns the user database in effect.
+func userDB() map[string]User {
+	return *users.Load()
+}
 
 // Load the .env file if it exists and set the valid environment variables.
 func loadDotEnv() {
@@ -215,18 +313,11 @@ func loadDotEnv() {
 	}
 }
 
-func loadUserList() error {
-	loadDotEnv()
+// readUserList parses the user database from the ICBMUserDb environment variable.
+func readUserList() (map[string]User, error) {
+	db := map[string]User{}
 	userdb := os.Getenv("ICBMUserDb")
 	j := strings.NewReader(userdb)
 	dec := json.NewDecoder(j)
-	return dec.Decode(&users)
-}
-
-func init() {
-	if err := loadUserList(); err != nil {
-		log.Println("Could not load user database, server will be read-only:", err)
-	} else {
-		log.Printf("User database loaded, %d entries\n", len(users))
-	}
+	return db, dec.Decode(&db)
 }
@@ -3,6 +3,7 @@
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -42,6 +43,7 @@ func randhex(bytes int) string {
 }
 
 func TestServer(t *testing.T) {
+	dataRoot = t.TempDir()
 	server := serve(":8080")
 	defer shutdown(server)
 	body := strings.NewReader(payload("Lunarville-beta"))
@@ -50,7 +52,7 @@ func TestServer(t *testing.T) {
 		t.Error("Error building request")
 	}
 	apikey := randhex(32)
-	users[apikey] = User{Username: "testbot", Valid: true}
+	userDB()[apikey] = User{Username: "testbot", Valid: true}
 	req.Header.Set("X-Icbm-Api-Key", apikey)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
@@ -78,3 +80,42 @@ func TestServer(t *testing.T) {
 		t.Errorf("\nReceived: %s\nExpected: %s\n", strings.TrimSpace(string(res)), "Fridge status updated for Lunarville-beta, thank you testbot")
 	}
 }
+
+func TestGracefulShutdown(t *testing.T) {
+	uploaded := make(chan bool, 1)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		background(func() {
+			time.Sleep(200 * time.Millisecond)
+			uploaded <- true
+		})
+		io.WriteString(w, "done")
+	})
+	srv := startServer("127.0.0.1:8081", slow, nil)
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://127.0.0.1:8081/")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- string(b)
+	}()
+	time.Sleep(50 * time.Millisecond) // let the request arrive
+
+	shutdown(srv)
+	select {
+	case <-uploaded:
+	default:
+		t.Error("shutdown returned before the background job finished")
+	}
+	if r := <-result; r != "done" {
+		t.Error("request in flight was not completed:", r)
+	}
+	if _, err := http.Get("http://127.0.0.1:8081/"); err == nil {
+		t.Error("still accepting connections after shutdown")
+	}
+}
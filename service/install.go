@@ -0,0 +1,267 @@
+// Package service installs and removes the ICBM server as a systemd service.
+package service
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+//go:embed icbm.service
+var unitTemplate string
+
+// Installer describes where and how the service is installed. The zero value
+// installs the running executable as svc-icbm in /svc/icbm.
+type Installer struct {
+	Root string   // install beneath this folder rather than /, for staging
+	User string   // account the service runs as (default: svc-icbm)
+	Home string   // home folder holding the executable and data (default: /svc/icbm)
+	Unit string   // systemd unit name (default: icbm)
+	Exe  string   // executable to install (default: the running one)
+	Args []string // arguments the service is started with (default: serve -http :80)
+
+	// Run executes a system command. The default runs it for real, unless
+	// Root is set, in which case the command is only logged.
+	Run func(name string, args ...string) error
+	Log io.Writer // progress messages (default: stderr)
+}
+
+func (in *Installer) defaults() {
+	if in.User == "" {
+		in.User = "svc-icbm"
+	}
+	if in.Home == "" {
+		in.Home = "/svc/icbm"
+	}
+	if in.Unit == "" {
+		in.Unit = "icbm"
+	}
+	if len(in.Args) == 0 {
+		in.Args = []string{"serve", "-http", ":80"}
+	}
+	if in.Log == nil {
+		in.Log = os.Stderr
+	}
+	if in.Run == nil {
+		in.Run = in.run
+	}
+}
+
+// staging reports whether we're installing somewhere other than the live system.
+func (in *Installer) staging() bool {
+	return in.Root != "" && in.Root != "/"
+}
+
+// path returns p beneath the install root.
+func (in *Installer) path(p string) string {
+	return filepath.Join(in.Root, p)
+}
+
+func (in *Installer) logf(format string, a ...any) {
+	fmt.Fprintf(in.Log, format+"\n", a...)
+}
+
+func (in *Installer) run(name string, args ...string) error {
+	in.logf("+ %s %s", name, strings.Join(args, " "))
+	if in.staging() {
+		return nil
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = in.Log, in.Log
+	return cmd.Run()
+}
+
+// unitPath returns where the systemd unit file lives.
+func (in *Installer) unitPath() string {
+	return in.path(filepath.Join("/etc/systemd/system", in.Unit+".service"))
+}
+
+// Install creates the service account and folders, copies the executable
+// into place, writes the unit file, and (re)starts the service. Running it
+// again upgrades an existing install.
+func (in *Installer) Install() error {
+	in.defaults()
+	if in.Exe == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("couldn't find this executable: %w", err)
+		}
+		in.Exe = exe
+	}
+	if !in.staging() && os.Geteuid() != 0 {
+		return fmt.Errorf("installing needs root, try sudo")
+	}
+
+	if err := in.addUser(); err != nil {
+		return err
+	}
+	for _, dir := range []struct {
+		path string
+		mode os.FileMode
+	}{{in.Home, 0755}, {filepath.Join(in.Home, "data"), 0755}, {filepath.Join(in.Home, "secrets"), 0700}} {
+		if err := os.MkdirAll(in.path(dir.path), dir.mode); err != nil {
+			return fmt.Errorf("couldn't create %s: %w", dir.path, err)
+		}
+		if err := in.chown(dir.path); err != nil {
+			return err
+		}
+	}
+
+	exe := filepath.Join(in.Home, "web")
+	if err := in.copyExe(in.path(exe)); err != nil {
+		return err
+	}
+	in.logf("installed %s", in.path(exe))
+
+	unit, err := in.render(exe)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(in.unitPath()), 0755); err != nil {
+		return fmt.Errorf("couldn't create the systemd folder: %w", err)
+	}
+	if old, _ := os.ReadFile(in.unitPath()); !bytes.Equal(old, unit) {
+		if err := os.WriteFile(in.unitPath(), unit, 0644); err != nil {
+			return fmt.Errorf("couldn't write the unit file: %w", err)
+		}
+		in.logf("wrote %s", in.unitPath())
+	}
+
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", in.Unit}, {"restart", in.Unit}} {
+		if err := in.Run("systemctl", args...); err != nil {
+			return fmt.Errorf("systemctl %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+// Uninstall stops and disables the service and removes the unit file and the
+// service account, leaving the home folder and its data in place.
+func (in *Installer) Uninstall() error {
+	in.defaults()
+	if !in.staging() && os.Geteuid() != 0 {
+		return fmt.Errorf("uninstalling needs root, try sudo")
+	}
+	if err := in.Run("systemctl", "disable", "--now", in.Unit); err != nil {
+		in.logf("couldn't disable %s, continuing: %s", in.Unit, err)
+	}
+	if err := os.Remove(in.unitPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't remove the unit file: %w", err)
+	}
+	if err := in.Run("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload: %w", err)
+	}
+	if in.userExists() {
+		if err := in.Run("userdel", in.User); err != nil {
+			return fmt.Errorf("couldn't remove user %s: %w", in.User, err)
+		}
+	}
+	in.logf("left %s in place", in.path(in.Home))
+	return nil
+}
+
+// userExists reports whether the service account exists. When staging we
+// can't tell, so assume not.
+func (in *Installer) userExists() bool {
+	if in.staging() {
+		return false
+	}
+	_, err := user.Lookup(in.User)
+	return err == nil
+}
+
+func (in *Installer) addUser() error {
+	if in.userExists() {
+		return nil
+	}
+	err := in.Run("useradd", "--system", "--home-dir", in.Home, "--no-create-home", "--shell", "/usr/sbin/nologin", in.User)
+	if err != nil {
+		return fmt.Errorf("couldn't create user %s: %w", in.User, err)
+	}
+	return nil
+}
+
+// chown gives p to the service account. Skipped when staging, as the account
+// only exists on the target system.
+func (in *Installer) chown(p string) error {
+	if in.staging() {
+		return nil
+	}
+	u, err := user.Lookup(in.User)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	return os.Chown(p, uid, gid)
+}
+
+// copyExe copies the executable to dst by way of a temporary file, so a
+// running copy can be replaced during an upgrade.
+func (in *Installer) copyExe(dst string) error {
+	if same(in.Exe, dst) {
+		return nil // upgrading in place, nothing to copy
+	}
+	src, err := os.Open(in.Exe)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", in.Exe, err)
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".web-")
+	if err != nil {
+		return fmt.Errorf("couldn't create a tempfile for %s: %w", dst, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't copy %s: %w", in.Exe, err)
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// same reports whether a and b are the same file.
+func same(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// render fills in the unit template.
+func (in *Installer) render(exe string) ([]byte, error) {
+	t, err := template.New("unit").Funcs(template.FuncMap{"quote": quote}).Parse(unitTemplate)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, struct {
+		User, Home, Exec string
+		Args             []string
+	}{in.User, in.Home, exe, in.Args})
+	return b.Bytes(), err
+}
+
+// quote wraps arguments containing spaces or quotes for systemd's ExecStart.
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return strconv.Quote(s)
+}
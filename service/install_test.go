@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallStaging(t *testing.T) {
+	root := t.TempDir()
+	exe := filepath.Join(t.TempDir(), "icbm")
+	os.WriteFile(exe, []byte("#!/bin/true\n"), 0755)
+
+	var ran []string
+	var log bytes.Buffer
+	in := &Installer{
+		Root: root,
+		Exe:  exe,
+		Args: []string{"serve", "-http", ":80", "-tlshosts", "a b"},
+		Run: func(name string, args ...string) error {
+			ran = append(ran, name+" "+strings.Join(args, " "))
+			return nil
+		},
+		Log: &log,
+	}
+	// Twice, as upgrades re-run the installer.
+	for i := 0; i < 2; i++ {
+		if err := in.Install(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b, err := os.ReadFile(filepath.Join(root, "svc/icbm/web")); err != nil || string(b) != "#!/bin/true\n" {
+		t.Error("executable not copied", err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "svc/icbm/secrets")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Error("secrets folder missing or too open", err)
+	}
+	unit, err := os.ReadFile(filepath.Join(root, "etc/systemd/system/icbm.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), `ExecStart=/svc/icbm/web serve -http :80 -tlshosts "a b"`) {
+		t.Errorf("unexpected unit file:\n%s", unit)
+	}
+	if strings.Count(log.String(), "wrote ") != 1 {
+		t.Error("unchanged unit file was rewritten")
+	}
+	if ran[0] != "useradd --system --home-dir /svc/icbm --no-create-home --shell /usr/sbin/nologin svc-icbm" || ran[len(ran)-1] != "systemctl restart icbm" {
+		t.Errorf("unexpected commands %q", ran)
+	}
+
+	if err := in.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/systemd/system/icbm.service")); !os.IsNotExist(err) {
+		t.Error("unit file left behind")
+	}
+	if _, err := os.Stat(filepath.Join(root, "svc/icbm/web")); err != nil {
+		t.Error("uninstall should leave the home folder alone")
+	}
+}
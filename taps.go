@@ -0,0 +1,267 @@
+package main
+
+// Fridges with several kegs send one report carrying a scale per tap. Each
+// tap is stored, charted and streamed as a series of its own, named
+// fridge.tap, with a page per tap and one for the whole fridge. A tap's
+// reports say which fridge it's a tap of, so a fridge which happens to be
+// called fridge.tap isn't taken for one.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tapSeries names the series a fridge's tap is stored under.
+func tapSeries(fridge, tap string) string {
+	return fridge + "." + tap
+}
+
+// tapName returns the name of the i'th tap's series within its fridge.
+func tapName(i int, t TapReport) string {
+	if name := sanitize(t.Name); name != "" {
+		return name
+	}
+	return fmt.Sprintf("tap%d", i+1)
+}
+
+var errBadTaps = errors.New("bad taps")
+
+// claimSeries makes sure each of a report's taps has a series of its own: no
+// two taps may share a name, and no tap may share a fridge's series. It
+// checks and claims the series under tapReportMu, so two reports can't both
+// claim one, adding an empty report for each series not in memory. A series
+// not in memory is looked up on disk beforehand, in case its samples have
+// aged out.
+func (r ICBMreport) claimSeries() error {
+	type claim struct{ series, tapOf string }
+	var claims []claim
+	if len(r.Taps) == 0 || len(r.RawSamples)+len(r.StableSamples) > 0 {
+		claims = append(claims, claim{r.FridgeName, ""})
+	}
+	seen := map[string]bool{}
+	for i, t := range r.Taps {
+		name := tapName(i, t)
+		if seen[name] {
+			return fmt.Errorf("%w: more than one tap is called %q", errBadTaps, name)
+		}
+		seen[name] = true
+		claims = append(claims, claim{tapSeries(r.FridgeName, name), r.FridgeName})
+	}
+
+	// Series not in memory are looked up on disk first, so no report waits
+	// on another's disk reads for the lock.
+	type stored struct {
+		owner string
+		found bool
+	}
+	onDisk := map[string]stored{}
+	for _, c := range claims {
+		if seriesReport(c.series) == nil {
+			owner, found := storedTapOf(c.series)
+			onDisk[c.series] = stored{owner, found}
+		}
+	}
+
+	tapReportMu.Lock()
+	defer tapReportMu.Unlock()
+	for _, c := range claims {
+		owner, found := "", false
+		if o := tapReport[c.series]; o != nil {
+			owner, found = o.tapOf(), true
+		} else if d, ok := onDisk[c.series]; ok {
+			owner, found = d.owner, d.found
+		} else {
+			continue // it was in memory, and has since aged out
+		}
+		switch {
+		case !found || owner == c.tapOf:
+		case c.tapOf == "":
+			return fmt.Errorf("%w: %s is a tap of %s", errBadTaps, c.series, owner)
+		default:
+			return fmt.Errorf("%w: tap %q would share %s with another fridge", errBadTaps, strings.TrimPrefix(c.series, r.FridgeName+"."), c.series)
+		}
+	}
+	for _, c := range claims {
+		if tapReport[c.series] == nil {
+			tapReport[c.series] = &ICBMreport{FridgeName: c.series, TapOf: c.tapOf, mu: &sync.Mutex{}}
+		}
+	}
+	return nil
+}
+
+// storedTapOf returns the fridge a series on disk is a tap of, going by its
+// latest report, and whether it has any reports.
+func storedTapOf(series string) (string, bool) {
+	reports, _ := readDirRe(filepath.Join(dataRoot, series), reportName.String())
+	if len(reports) == 0 {
+		return "", false
+	}
+	rep, err := readReport(filepath.Join(dataRoot, series, reports[len(reports)-1].Name()))
+	if err != nil {
+		slog.Warn("Couldn't read a report to see whose series it is", "err", err)
+		return "", true
+	}
+	return rep.TapOf, true
+}
+
+// tapOf returns the fridge a series is a tap of, if it's a tap.
+func (r *ICBMreport) tapOf() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.TapOf
+}
+
+// split returns the report as one report per series: the fridge's own
+// samples, if any, then one for each tap with that tap's calibration.
+func (r ICBMreport) split() []ICBMreport {
+	var reps []ICBMreport
+	if len(r.Taps) == 0 || len(r.RawSamples)+len(r.StableSamples) > 0 {
+		own := r
+		own.Taps, own.TapOf = nil, ""
+		own.mu = &sync.Mutex{}
+		reps = append(reps, own)
+	}
+	for i, t := range r.Taps {
+		reps = append(reps, ICBMreport{
+			FridgeName:    tapSeries(r.FridgeName, tapName(i, t)),
+			RawMassFull:   t.RawMassFull,
+			RawMassTare:   t.RawMassTare,
+			RawSamples:    t.RawSamples,
+			StableSamples: t.StableSamples,
+			Units:         t.Units,
+			ClockFix:      r.ClockFix,
+			TapOf:         r.FridgeName,
+			mu:            &sync.Mutex{},
+		})
+	}
+	return reps
+}
+
+// fridgeTaps returns the names of the taps a fridge has reported, sorted.
+func fridgeTaps(fridge string) []string {
+	var taps []string
+	if fridge == "" {
+		return nil
+	}
+	for _, series := range allSeries() {
+		r := seriesReport(series)
+		if r == nil || r.tapOf() != fridge {
+			continue
+		}
+		if _, ok := r.latest(); ok {
+			taps = append(taps, strings.TrimPrefix(series, fridge+"."))
+		}
+	}
+	return taps
+}
+
+// tapsOf returns the series of a fridge's taps.
+func tapsOf(fridge string) []string {
+	var all []string
+	for _, tap := range fridgeTaps(fridge) {
+		all = append(all, tapSeries(fridge, tap))
+	}
+	return all
+}
+
+// fridgeConfig returns the configuration of a fridge, or one showing the
+// stock glass if it isn't configured.
+func fridgeConfig(fridge string) FridgeConfig {
+	for _, f := range conf().Fridges {
+		if f.Name == fridge {
+			return f
+		}
+	}
+	return FridgeConfig{Name: fridge, Template: "Lunarville.tmpl"}
+}
+
+// tapPage renders the page for one tap, with the path fridge/tap. It uses the
+// fridge's template.
+func tapPage(w http.ResponseWriter, r *http.Request) {
+	fridge, tap, ok := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	series := tapSeries(fridge, tap)
+	if !ok || seriesReport(series) == nil {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = fridge
+	io.WriteString(w, renderPage(fridgeConfig(fridge), series))
+}
+
+// TapSummary is one tap in a FridgeSummary.
+type TapSummary struct {
+	Name      string
+	FillRatio float64
+	LastTime  time.Time
+	Page      string    // path of the tap's own page
+	Beverage  *Beverage `json:",omitempty"`
+}
+
+// FridgeSummary is the aggregated view of a fridge's taps.
+type FridgeSummary struct {
+	Fridge    string
+	FillRatio float64 // the average over the taps
+	Taps      []TapSummary
+}
+
+// Percent is how full the tap is, for templates.
+func (t TapSummary) Percent() float64 { return t.FillRatio * 100 }
+
+// Percent is how full the fridge's taps are on average, for templates.
+func (fs FridgeSummary) Percent() float64 { return fs.FillRatio * 100 }
+
+// summarize gathers the latest sample of each of a fridge's taps.
+func summarize(fridge string) FridgeSummary {
+	fs := FridgeSummary{Fridge: fridge, Taps: []TapSummary{}}
+	for _, tap := range fridgeTaps(fridge) {
+		s, _ := seriesReport(tapSeries(fridge, tap)).latest()
+		fs.Taps = append(fs.Taps, TapSummary{
+			Name:      tap,
+			FillRatio: clamp(s.PubFillRatio, 0.0, 1.0),
+			LastTime:  s.Timestamp,
+			Page:      "/tap/" + fridge + "/" + tap,
+			Beverage:  onTap(tapSeries(fridge, tap)),
+		})
+		fs.FillRatio += clamp(s.PubFillRatio, 0.0, 1.0)
+	}
+	if len(fs.Taps) > 0 {
+		fs.FillRatio /= float64(len(fs.Taps))
+	}
+	return fs
+}
+
+// fridgeOverview shows every tap of a fridge, with the fridge name as the
+// path. Add ?format=json for the data alone.
+func fridgeOverview(w http.ResponseWriter, r *http.Request) {
+	fridge := strings.Trim(r.URL.Path, "/")
+	fs := summarize(fridge)
+	if len(fs.Taps) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = fridge
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fs)
+		return
+	}
+	var b bytes.Buffer
+	if err := templates.Load().ExecuteTemplate(&b, "fridge.tmpl", fs); err != nil {
+		slog.Error("Could not execute template", "template", "fridge.tmpl", "err", err)
+		http.Error(w, "Couldn't render the page", http.StatusInternalServerError)
+		return
+	}
+	b.WriteTo(w)
+}
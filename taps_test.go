@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaps(t *testing.T) {
+	freshData(t)
+	c := *conf()
+	c.Limits.KeyPerMinute, c.Limits.IPPerMinute = 0, 0
+	current.Store(&c)
+	apikey := randhex(32)
+	users.Store(&map[string]User{apikey: {Username: "testbot", Valid: true}})
+
+	at := time.Now().UTC().Truncate(time.Second)
+	tap := func(name string, fill float64) TapReport {
+		return TapReport{
+			Name: name, RawMassFull: 2000, RawMassTare: 1000,
+			RawSamples:    []Sample{{Timestamp: at, RawMass: 1000 + int(fill*1000), RawFillRatio: fill, PubFillRatio: fill}},
+			StableSamples: []Sample{{Timestamp: at, RawMass: 1000 + int(fill*1000), RawFillRatio: fill, PubFillRatio: fill}},
+		}
+	}
+	post := func(rep ICBMreport) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(rep)
+		r := httptest.NewRequest("POST", "/icbm/v1", strings.NewReader(string(body)))
+		r.Header.Set("X-Icbm-Api-Key", apikey)
+		w := httptest.NewRecorder()
+		icbmUpdate(w, r)
+		return w
+	}
+	if w := post(ICBMreport{FridgeName: "Taproom", Taps: []TapReport{tap("stout", 0.25), tap("pale ale", 0.75)}}); w.Code != http.StatusOK {
+		t.Fatalf("multi-tap upload: %d %s", w.Code, w.Body)
+	}
+
+	for series, fill := range map[string]float64{"Taproom.stout": 0.25, "Taproom.paleale": 0.75} {
+		stored, err := readReport(mustGlob(t, filepath.Join(dataRoot, series, "*.json.gz")))
+		if err != nil || len(stored.StableSamples) != 1 || stored.StableSamples[0].PubFillRatio != fill || stored.RawMassFull != 2000 {
+			t.Errorf("%s not stored on its own: %v %+v", series, err, stored)
+		}
+		if _, err := os.Stat(filepath.Join(dataRoot, series+".tsv")); err != nil {
+			t.Errorf("%s has no chart data: %s", series, err)
+		}
+	}
+	// Only the fridge's clock log, which isn't per tap, is kept under its name.
+	if m, _ := filepath.Glob(filepath.Join(dataRoot, "Taproom", "*.json.gz")); len(m) > 0 {
+		t.Errorf("a report with only taps shouldn't store a report for the fridge itself: %v", m)
+	}
+	if _, err := os.Stat(filepath.Join(dataRoot, "Taproom.tsv")); err == nil {
+		t.Error("a report with only taps shouldn't chart the fridge itself")
+	}
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, page := get("/tap/Taproom/stout"); code != http.StatusOK || !strings.Contains(page, "/events/Taproom.stout") {
+		t.Errorf("tap page: %d %s", code, page)
+	}
+	if code, _ := get("/tap/Taproom/porter"); code != http.StatusNotFound {
+		t.Errorf("unknown tap: expected 404, got %d", code)
+	}
+	if code, page := get("/fridge/Taproom"); code != http.StatusOK || !strings.Contains(page, `href="/tap/Taproom/paleale"`) {
+		t.Errorf("fridge page: %d %s", code, page)
+	}
+	code, js := get("/fridge/Taproom?format=json")
+	var fs FridgeSummary
+	if err := json.Unmarshal([]byte(js), &fs); code != http.StatusOK || err != nil {
+		t.Fatalf("fridge json: %d %v %s", code, err, js)
+	}
+	if len(fs.Taps) != 2 || fs.Taps[0].Name != "paleale" || fs.FillRatio != 0.5 {
+		t.Errorf("unexpected summary %+v", fs)
+	}
+
+	// Taps can't share a series, with each other or with another fridge.
+	if w := post(ICBMreport{FridgeName: "Dupes", Taps: []TapReport{tap("pale ale", 0.5), tap("paleale", 0.5)}}); w.Code != http.StatusBadRequest {
+		t.Errorf("taps with the same name: expected 400, got %d %s", w.Code, w.Body)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dataRoot, "Dupes*")); len(m) > 0 {
+		t.Errorf("a report with clashing taps was stored: %v", m)
+	}
+	own := tap("", 0.5)
+	if w := post(ICBMreport{FridgeName: "Taproom.x", StableSamples: own.StableSamples}); w.Code != http.StatusOK {
+		t.Errorf("a fridge with a dot in its name: %d %s", w.Code, w.Body)
+	}
+	if fs := summarize("Taproom"); len(fs.Taps) != 2 {
+		t.Errorf("another fridge taken for a tap: %+v", fs)
+	}
+	if w := post(ICBMreport{FridgeName: "Taproom", Taps: []TapReport{tap("x", 0.5)}}); w.Code != http.StatusBadRequest {
+		t.Errorf("a tap clashing with a fridge: expected 400, got %d %s", w.Code, w.Body)
+	}
+	if w := post(ICBMreport{FridgeName: "Taproom.stout", StableSamples: own.StableSamples}); w.Code != http.StatusBadRequest {
+		t.Errorf("a fridge clashing with a tap: expected 400, got %d %s", w.Code, w.Body)
+	}
+
+	// A tap whose samples have aged out of memory is still the fridge's.
+	tapReportMu.Lock()
+	delete(tapReport, "Taproom.stout")
+	tapReportMu.Unlock()
+	if w := post(ICBMreport{FridgeName: "Taproom.stout", StableSamples: own.StableSamples}); w.Code != http.StatusBadRequest {
+		t.Errorf("a fridge clashing with an aged out tap: expected 400, got %d %s", w.Code, w.Body)
+	}
+	if w := post(ICBMreport{FridgeName: "Taproom", Taps: []TapReport{tap("stout", 0.2)}}); w.Code != http.StatusOK {
+		t.Errorf("a tap back from aging out: %d %s", w.Code, w.Body)
+	}
+
+	// Of a fridge and a tap reporting at once for one series, only one gets it.
+	codes := make(chan int, 2)
+	for _, rep := range []ICBMreport{
+		{FridgeName: "Racing", Taps: []TapReport{tap("ale", 0.5)}},
+		{FridgeName: "Racing.ale", StableSamples: own.StableSamples},
+	} {
+		go func() { codes <- post(rep).Code }()
+	}
+	if a, b := <-codes, <-codes; a+b != http.StatusOK+http.StatusBadRequest {
+		t.Errorf("both or neither claimed Racing.ale: %d and %d", a, b)
+	}
+}
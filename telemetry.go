@@ -4,49 +4,66 @@
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// // Metrics keeps some basic stats about our health and usage for the logs.
-// type Metrics struct {
-// 	TCPResets     int64
-// 	DataPoints    int64
-// 	APILogins     int64
-// 	BadLogins     int64
-// 	BadJSON       int64
-// 	Errors        int64
-// 	HTTP          int64
-// 	HTTPDuration  uint64
-// 	HTTPS         int64
-// 	HTTPSDuration uint64
-// 	ReadTimeout   int64
-// 	CorsListed    int64
-// 	CorsUnlisted  int64
-// }
-
-// var metrics = Metrics{}
-// var statsChan chan Sample = AggregateUpdates() // StatsChan aggregates samples written to it.
-
-type denoise struct {
-	needle  []byte
-	counter *int64
+// counters are named event counts, such as filtered log lines, served on /metrics.
+var counters sync.Map // name -> *atomic.Int64
+
+var validCounter = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// count adds one to the named counter.
+func count(name string) {
+	countN(name, 1)
+}
+
+// countN adds n to the named counter.
+func countN(name string, n int) {
+	v, _ := counters.LoadOrStore(name, new(atomic.Int64))
+	v.(*atomic.Int64).Add(int64(n))
+}
+
+// writeCounters prints every counter in the Prometheus text format.
+func writeCounters(w io.Writer) {
+	var names []string
+	counters.Range(func(k, _ any) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		v, _ := counters.Load(name)
+		fmt.Fprintf(w, "# TYPE icbm_%s counter\nicbm_%s %d\n", name, name, v.(*atomic.Int64).Load())
+	}
 }
 
 // denoiseWriter suppresses logging specific errors and converts them to metrics instead
 type denoiseWriter struct {
-	out     io.Writer
-	filters []denoise
+	out io.Writer
 }
 
-// filterWriter's Write silently suppresses lines which contain any needles in fw.filters.
+// Write suppresses lines which match any of the configured Log.Filters,
+// counting them instead.
 func (fw *denoiseWriter) Write(p []byte) (n int, err error) {
-	for _, f := range fw.filters {
-		if bytes.Contains(p, f.needle) {
-			if f.counter != nil {
-				*f.counter++ // increment the associated metric
+	for _, f := range conf().Log.Filters {
+		if bytes.Contains(p, []byte(f.Match)) {
+			if f.Counter != "" {
+				count(f.Counter) // increment the associated metric
 			}
 			return len(p), nil
 		}
@@ -54,22 +71,201 @@ func (fw *denoiseWriter) Write(p []byte) (n int, err error) {
 	return fw.out.Write(p)
 }
 
-// FilteredHTTPLogger removes a bunch of noise from the logs and converts them to metrics instead.
+// FilteredHTTPLogger removes the noise configured in Log.Filters from the logs
+// and converts it to metrics instead.
 func FilteredHTTPLogger(w io.Writer) io.Writer {
-	// My assumption is that these are due to random port scans.
-	return &denoiseWriter{w, []denoise{
-		{[]byte("http: TLS handshake error from"), nil /*&metrics.TCPResets*/},
-		{[]byte("server: error reading preface from client"), nil /*&metrics.ReadTimeout*/},
-	}}
+	return &denoiseWriter{w}
+}
+
+// slogWriter turns lines from a standard library *log.Logger into slog records.
+type slogWriter struct {
+	level slog.Level
+}
+
+func (sw slogWriter) Write(p []byte) (int, error) {
+	slog.Log(context.Background(), sw.level, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// logLevel is the level of the default logger, adjusted by setupLogging.
+var logLevel slog.LevelVar
+
+// accessLog logs one line per request, or is nil if the access log is off.
+var accessLog atomic.Pointer[slog.Logger]
+
+// accessFile is the open Log.AccessFile, closed accessLogGrace after the
+// access log is replaced.
+var accessFile atomic.Pointer[os.File]
+
+// accessLogGrace is how long a replaced access log file is kept open, so
+// requests which picked it up just before can finish writing to it.
+const accessLogGrace = 10 * time.Second
+
+// newLogHandler returns a slog handler writing format ("text" or "json") to w.
+func newLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level:     level,
+		AddSource: !superfly(),
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch {
+			case len(groups) > 0:
+			case a.Key == slog.TimeKey && superfly():
+				return slog.Attr{} // fly adds its own timestamps
+			case a.Key == slog.SourceKey:
+				if src, ok := a.Value.Any().(*slog.Source); ok {
+					a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+				}
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging configures the default logger, which the log package also
+// writes through, and the access log.
+func setupLogging(c LogConfig) error {
+	if err := logLevel.UnmarshalText([]byte(c.Level)); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(&fridgeErrors{Handler: newLogHandler(os.Stderr, c.Format, &logLevel)}))
+
+	var al *slog.Logger
+	var f *os.File
+	if c.Access != "off" {
+		var w io.Writer = os.Stderr
+		if c.AccessFile != "" {
+			var err error
+			f, err = os.OpenFile(c.AccessFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return fmt.Errorf("couldn't open the access log: %w", err)
+			}
+			w = f
+		}
+		al = slog.New(newLogHandler(w, c.Access, slog.LevelInfo))
+	}
+	accessLog.Store(al)
+	if old := accessFile.Swap(f); old != nil {
+		time.AfterFunc(accessLogGrace, func() { old.Close() })
+	}
+	return nil
+}
+
+type ctxKey int
+
+const requestInfoKey ctxKey = iota
+
+// requestInfo describes the request being handled. Handlers fill in Fridge
+// and User as they learn them, for the access log.
+type requestInfo struct {
+	ID     string
+	Fridge string
+	User   string
 }
 
+// reqInfo returns the request's info, or a throwaway one outside a request.
+func reqInfo(ctx context.Context) *requestInfo {
+	if ri, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return ri
+	}
+	return &requestInfo{}
+}
+
+// ctxLog returns the default logger, tagged with the request ID if ctx has one.
+func ctxLog(ctx context.Context) *slog.Logger {
+	if ri, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return slog.With("req", ri.ID)
+	}
+	return slog.Default()
+}
+
+var validRequestID = regexp.MustCompile(`^[[:alnum:]-]{1,64}$`)
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through so streaming responses still work.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// logRequests gives each request an ID (reusing a sane X-Request-Id from the
+// client) and writes the access log once it's done.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ri := &requestInfo{ID: r.Header.Get("X-Request-Id")}
+		if !validRequestID.MatchString(ri.ID) {
+			ri.ID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", ri.ID)
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoKey, ri)))
+
+		al := accessLog.Load()
+		if al == nil {
+			return
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		al.Info("access",
+			"req", ri.ID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+			"fridge", ri.Fridge,
+			"user", ri.User,
+		)
+	})
+}
+
+// dataRoot is the folder holding all fridge data, see dataPath.
+var dataRoot = defaultConfig().DataRoot
+
 // dataPath returns a path in the /data folder joined by []subdirs underneath it.
 func dataPath(subdirs ...string) string {
-	root := "data"
-	if superfly() {
-		root = "/data"
-	}
-	ee := append([]string{root}, subdirs...) // full path to target
+	ee := append([]string{dataRoot}, subdirs...) // full path to target
 
 	filename := path.Join(ee...)
 	dir := filepath.Dir(filename)
@@ -77,8 +273,15 @@ func dataPath(subdirs ...string) string {
 	return filename
 }
 
-func servePrometheus() {
-	// prom := http.NewServeMux()
-	// prom.Handle("/metrics", promhttp.Handler())
-	// http.ListenAndServe(":9091", prom)
+// servePrometheus serves the counters on /metrics at conf().Metrics, if set.
+func servePrometheus() *http.Server {
+	if conf().Metrics == "" {
+		return nil
+	}
+	prom := http.NewServeMux()
+	prom.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeCounters(w)
+	})
+	return startServer(conf().Metrics, prom, nil)
 }
@@ -2,12 +2,17 @@
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -134,3 +139,92 @@ func TestTrimHistory(t *testing.T) {
 			lines[lineCount-1], targets[lineCount+extra-1])
 	}
 }
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	accessLog.Store(slog.New(newLogHandler(&buf, "json", slog.LevelInfo)))
+	defer accessLog.Store(nil)
+
+	var seen string
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ri := reqInfo(r.Context())
+		seen, ri.Fridge = ri.ID, "Lunarville"
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	r := httptest.NewRequest("POST", "/icbm/v1", nil)
+	r.Header.Set("X-Request-Id", "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if seen != "abc-123" || w.Header().Get("X-Request-Id") != "abc-123" {
+		t.Errorf("request ID not carried through: handler saw %q, response has %q", seen, w.Header().Get("X-Request-Id"))
+	}
+	var entry struct {
+		Req, Method, Path, Fridge string
+		Status                    int
+		Bytes                     int64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("bad access log line %q: %s", buf.String(), err)
+	}
+	if entry.Req != "abc-123" || entry.Method != "POST" || entry.Path != "/icbm/v1" ||
+		entry.Fridge != "Lunarville" || entry.Status != http.StatusTeapot || entry.Bytes != 5 {
+		t.Errorf("unexpected access log entry %+v", entry)
+	}
+
+	// A junk ID from the client is replaced.
+	r.Header.Set("X-Request-Id", "not valid\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get("X-Request-Id"); !validRequestID.MatchString(id) || id == "abc-123" {
+		t.Errorf("expected a fresh request ID, got %q", id)
+	}
+}
+
+func TestAccessLogSwap(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer accessLog.Store(nil)
+	dir := t.TempDir()
+	first, second := path.Join(dir, "first.log"), path.Join(dir, "second.log")
+	if err := setupLogging(LogConfig{Level: "info", Format: "text", Access: "json", AccessFile: first}); err != nil {
+		t.Fatal(err)
+	}
+	al := accessLog.Load()
+	if err := setupLogging(LogConfig{Level: "info", Format: "text", Access: "json", AccessFile: second}); err != nil {
+		t.Fatal(err)
+	}
+	// A request which picked up the old log as it was replaced still gets
+	// its line written.
+	al.Info("access", "path", "/late")
+	if b, _ := os.ReadFile(first); !strings.Contains(string(b), "/late") {
+		t.Errorf("line logged just after a reload was lost: %q", b)
+	}
+	accessFile.Swap(nil).Close()
+}
+
+func TestDenoise(t *testing.T) {
+	var buf bytes.Buffer
+	w := FilteredHTTPLogger(&buf)
+	before := counterValue("tls_handshake_errors")
+	fmt.Fprintln(w, "http: TLS handshake error from 1.2.3.4:5678: EOF")
+	fmt.Fprintln(w, "something worth seeing")
+	if got := counterValue("tls_handshake_errors") - before; got != 1 {
+		t.Errorf("expected the filtered line to be counted once, got %d", got)
+	}
+	if buf.String() != "something worth seeing\n" {
+		t.Errorf("unexpected log output %q", buf.String())
+	}
+
+	var metrics bytes.Buffer
+	writeCounters(&metrics)
+	if !strings.Contains(metrics.String(), "icbm_tls_handshake_errors ") {
+		t.Errorf("counter missing from /metrics output:\n%s", metrics.String())
+	}
+}
+
+func counterValue(name string) int64 {
+	if v, ok := counters.Load(name); ok {
+		return v.(*atomic.Int64).Load()
+	}
+	return 0
+}
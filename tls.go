@@ -0,0 +1,215 @@
+package main
+
+// Native HTTPS. Certificates come from files on disk, picked by SNI and
+// reloaded when the files change, or are generated at startup for local
+// development.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certPoll is how often certificate files are checked for changes.
+const certPoll = 30 * time.Second
+
+// certStore holds the certificates served over TLS.
+type certStore struct {
+	hosts []string // if set, the only names we'll answer for
+	pairs []CertPair
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	modTime []time.Time
+}
+
+// newCertStore loads the certificates described by tc, or generates one if
+// tc.SelfSigned is set.
+func newCertStore(tc TLSConfig) (*certStore, error) {
+	cs := &certStore{hosts: tc.Hosts, pairs: tc.Certs}
+	if tc.SelfSigned {
+		cert, err := selfSigned(tc.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't generate a self-signed certificate: %w", err)
+		}
+		cs.certs = []*tls.Certificate{cert}
+		return cs, nil
+	}
+	cs.certs = make([]*tls.Certificate, len(cs.pairs))
+	cs.modTime = make([]time.Time, len(cs.pairs))
+	for i := range cs.pairs {
+		if _, err := cs.load(i); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// load (re)reads the i'th certificate pair if it has changed since it was
+// last read, and reports whether it did. On error the previous certificate is
+// kept.
+func (cs *certStore) load(i int) (bool, error) {
+	p := cs.pairs[i]
+	fi, err := os.Stat(p.Cert)
+	if err != nil {
+		return false, fmt.Errorf("couldn't read certificate: %w", err)
+	}
+	ki, err := os.Stat(p.Key)
+	if err != nil {
+		return false, fmt.Errorf("couldn't read key: %w", err)
+	}
+	mod := fi.ModTime()
+	if ki.ModTime().After(mod) {
+		mod = ki.ModTime()
+	}
+	cs.mu.RLock()
+	unchanged := mod.Equal(cs.modTime[i])
+	cs.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+	if err != nil {
+		return false, fmt.Errorf("couldn't load %s: %w", p.Cert, err)
+	}
+	cs.mu.Lock()
+	cs.certs[i] = &cert
+	cs.modTime[i] = mod
+	cs.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads any certificate files which change, until stop is closed.
+func (cs *certStore) watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		for i := range cs.pairs {
+			changed, err := cs.load(i)
+			if err != nil {
+				slog.Error("Keeping the old certificate", "err", err)
+			} else if changed {
+				slog.Info("Reloaded certificate", "cert", cs.pairs[i].Cert)
+			}
+		}
+	}
+}
+
+// GetCertificate picks the certificate for the name the client asked for,
+// falling back to the first one.
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(cs.hosts) > 0 && name != "" && !matchHost(cs.hosts, name) {
+		return nil, fmt.Errorf("not configured to serve %q", name)
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, c := range cs.certs {
+		if c.Leaf != nil && c.Leaf.VerifyHostname(name) == nil {
+			return c, nil
+		}
+	}
+	return cs.certs[0], nil
+}
+
+// matchHost reports whether name is listed in hosts, allowing *.example.com
+// style wildcards for a single label.
+func matchHost(hosts []string, name string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if h == name {
+			return true
+		}
+		if suffix, found := strings.CutPrefix(h, "*."); found {
+			if label, rest, _ := strings.Cut(name, "."); label != "" && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the server side TLS settings using the store's certificates.
+func (cs *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cs.GetCertificate,
+	}
+}
+
+// selfSigned generates a certificate good for a year for hosts, or localhost.
+func selfSigned(hosts []string) (*tls.Certificate, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ICBM self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// redirectHTTPS sends every request to the same path over https, on the port
+// httpsaddr listens on.
+func redirectHTTPS(httpsaddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsaddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := *r.URL
+		u.Scheme, u.Host = "https", host
+		// 308 rather than 301 so fridges POSTing to http keep their method and body.
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
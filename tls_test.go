@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair saves a self-signed certificate for host as PEM files in dir.
+func writePair(t *testing.T, dir, host string) CertPair {
+	cert, err := selfSigned([]string{host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := CertPair{Cert: filepath.Join(dir, host+".crt"), Key: filepath.Join(dir, host+".key")}
+	os.WriteFile(p.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(p.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	return p
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	a, b := writePair(t, dir, "a.example.com"), writePair(t, dir, "b.example.com")
+	cs, err := newCertStore(TLSConfig{Hosts: []string{"a.example.com", "*.example.com"}, Certs: []CertPair{a, b}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pick := func(name string) *tls.Certificate {
+		c, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		return c
+	}
+	if pick("b.example.com").Leaf.VerifyHostname("b.example.com") != nil {
+		t.Error("SNI didn't pick the matching certificate")
+	}
+	if _, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.org"}); err == nil {
+		t.Error("expected unlisted hosts to be refused")
+	}
+
+	// Replace b's files with a different certificate and check it's picked up.
+	before := pick("b.example.com")
+	time.Sleep(10 * time.Millisecond)
+	writePair(t, dir, "b.example.com")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(b.Cert, later, later)
+	if changed, err := cs.load(1); !changed || err != nil {
+		t.Fatal("certificate not reloaded", err)
+	}
+	if pick("b.example.com") == before {
+		t.Error("still serving the old certificate")
+	}
+
+	// A broken file keeps the previous certificate.
+	os.WriteFile(b.Cert, []byte("garbage"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(b.Cert, later, later)
+	if _, err := cs.load(1); err == nil {
+		t.Error("expected an error loading a bad certificate")
+	}
+	if pick("b.example.com") == nil {
+		t.Error("lost the certificate after a bad reload")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	for _, tr := range []struct{ addr, host, expected string }{
+		{":443", "lunarville.org", "https://lunarville.org/icbm/v1?x=1"},
+		{":443", "lunarville.org:80", "https://lunarville.org/icbm/v1?x=1"},
+		{":8443", "localhost:8080", "https://localhost:8443/icbm/v1?x=1"},
+	} {
+		req := httptest.NewRequest("POST", "http://"+tr.host+"/icbm/v1?x=1", nil)
+		w := httptest.NewRecorder()
+		redirectHTTPS(tr.addr).ServeHTTP(w, req)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tr.expected {
+			t.Errorf("%s: got %d %s, expected %s", tr.host, w.Code, w.Header().Get("Location"), tr.expected)
+		}
+	}
+}
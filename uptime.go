@@ -0,0 +1,130 @@
+package main
+
+// Gaps and uptime. Fridges send a stable sample every Uptime.Cadence, so a
+// stretch of GapFactor times that without one is a gap: the fridge was off,
+// or offline, or its reports were lost. Uptime is the share of a period
+// which wasn't in a gap.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Gap is a stretch without stable samples.
+type Gap struct {
+	Start  time.Time
+	End    time.Time
+	Length duration
+}
+
+// gapAfter is how long without a stable sample makes a gap.
+func gapAfter() time.Duration {
+	u := conf().Uptime
+	return time.Duration(float64(u.Cadence.Duration) * u.GapFactor)
+}
+
+// findGaps returns the gaps in sorted samples between from and until,
+// including before the first and after the last.
+func findGaps(ss []Sample, from, until time.Time, limit time.Duration) []Gap {
+	found := []Gap{}
+	last := from
+	for _, s := range ss {
+		if s.Timestamp.Before(from) || s.Timestamp.After(until) {
+			continue
+		}
+		if d := s.Timestamp.Sub(last); d > limit {
+			found = append(found, Gap{last, s.Timestamp, duration{d}})
+		}
+		last = s.Timestamp
+	}
+	if d := until.Sub(last); d > limit {
+		found = append(found, Gap{last, until, duration{d}})
+	}
+	return found
+}
+
+// Uptime is how much of a period a fridge was reporting.
+type Uptime struct {
+	Period  string // day, week or month
+	Since   time.Time
+	Percent float64
+	Gaps    int
+	Missing duration // the total length of the gaps
+}
+
+// uptimeOf works out the uptime over a period from sorted samples.
+func uptimeOf(ss []Sample, period string, since, until time.Time) Uptime {
+	u := Uptime{Period: period, Since: since, Percent: 100}
+	gaps := findGaps(ss, since, until, gapAfter())
+	for _, g := range gaps {
+		u.Missing.Duration += g.Length.Duration
+	}
+	u.Gaps = len(gaps)
+	if span := until.Sub(since); span > 0 {
+		u.Percent = clamp(100*(1-u.Missing.Seconds()/span.Seconds()), 0.0, 100.0)
+	}
+	return u
+}
+
+// uptimeSince works out a series' uptime over a period from its sorted
+// samples. A fridge which started reporting during the period, its first
+// report on disk not from before the period's first day, is only counted
+// from its first sample, rather than as missing for the time before it.
+func uptimeSince(ss []Sample, first time.Time, period string, since, until time.Time) Uptime {
+	recorded := !first.IsZero() && first.Before(since.Truncate(24*time.Hour))
+	if len(ss) > 0 && ss[0].Timestamp.After(since) && !recorded {
+		since = ss[0].Timestamp
+	}
+	return uptimeOf(ss, period, since, until)
+}
+
+// uptimes returns a series' uptime over the last day, week and month, from
+// one read of the month's samples.
+func uptimes(series string, now time.Time) []Uptime {
+	ss := stableSince(series, now.Add(-30*24*time.Hour))
+	first := firstReported(series)
+	var ups []Uptime
+	for _, p := range []struct {
+		name string
+		days time.Duration
+	}{{"day", 1}, {"week", 7}, {"month", 30}} {
+		ups = append(ups, uptimeSince(ss, first, p.name, now.Add(-p.days*24*time.Hour), now))
+	}
+	return ups
+}
+
+// UptimeReport is a series' uptime and gaps, for /uptime/{fridge}.
+type UptimeReport struct {
+	Fridge   string
+	GapAfter duration
+	Uptime   []Uptime
+	Gaps     []Gap // since ?since=, latest last
+}
+
+// fridgeUptime answers /uptime/{fridge} with the fridge's uptime over the
+// last day, week and month, and its gaps over the last week, or the duration
+// given by ?since=, as JSON.
+func fridgeUptime(w http.ResponseWriter, r *http.Request) {
+	series := strings.Trim(r.URL.Path, "/")
+	if !knownFridge(series) {
+		http.NotFound(w, r)
+		return
+	}
+	reqInfo(r.Context()).Fridge = series
+	since, err := sinceParam(r, 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	rep := UptimeReport{
+		Fridge:   series,
+		GapAfter: duration{gapAfter()},
+		Uptime:   uptimes(series, now),
+		Gaps:     findGaps(stableSince(series, since), since, now, gapAfter()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
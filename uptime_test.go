@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUptime(t *testing.T) {
+	freshData(t)
+	fridge := "Uptimeville"
+
+	// A sample a minute for the last day, but for two hours off in the
+	// middle and nothing in the last hour.
+	now := time.Now().UTC().Truncate(time.Minute)
+	var ss []Sample
+	for m := 1440; m >= 60; m-- {
+		if m < 720 && m > 600 {
+			continue
+		}
+		ss = append(ss, Sample{Timestamp: now.Add(-time.Duration(m) * time.Minute), PubFillRatio: 0.5})
+	}
+	tapReport[fridge] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fridge, StableSamples: ss})
+
+	gaps := findGaps(ss, now.Add(-24*time.Hour), now, gapAfter())
+	if len(gaps) != 2 || gaps[0].Length.Duration != 2*time.Hour || !gaps[1].End.Equal(now) || gaps[1].Length.Duration != time.Hour {
+		t.Errorf("unexpected gaps %+v", gaps)
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	ups := uptimes(fridge, now)
+	for i, want := range []float64{
+		100 * (1 - 180.0/1440), // a day
+		100 * (1 - 180.0/1440), // a week, but it's only reported for a day
+		100 * (1 - 180.0/1440), // a month
+	} {
+		if !near(ups[i].Percent, want) || !ups[i].Since.Equal(now.Add(-24*time.Hour)) {
+			t.Errorf("%s uptime: got %g%% since %s, want %g%% since the first sample", ups[i].Period, ups[i].Percent, ups[i].Since, want)
+		}
+	}
+
+	// Had it reported before, it was missing for most of the week and month.
+	os.MkdirAll(filepath.Join(dataRoot, fridge), 0755)
+	os.WriteFile(filepath.Join(dataRoot, fridge, "20180913.json.gz"), nil, 0644)
+	ups = uptimes(fridge, now)
+	for i, want := range []float64{
+		100 * (1 - 180.0/1440),
+		100 * (1260.0 / 10080),
+		100 * (1260.0 / 43200),
+	} {
+		if !near(ups[i].Percent, want) {
+			t.Errorf("%s uptime with older reports: got %g%%, want %g%%", ups[i].Period, ups[i].Percent, want)
+		}
+	}
+
+	srv := httptest.NewServer(Routes())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/uptime/" + fridge + "?since=24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep UptimeReport
+	err = json.NewDecoder(resp.Body).Decode(&rep)
+	resp.Body.Close()
+	if err != nil || len(rep.Gaps) != 2 || len(rep.Uptime) != 3 || rep.GapAfter.Duration != 3*time.Minute {
+		t.Errorf("unexpected uptime report %+v, %v", rep, err)
+	}
+	for path, code := range map[string]int{"/uptime/nosuchfridge": http.StatusNotFound, "/uptime/" + fridge + "?since=ages": http.StatusBadRequest} {
+		if resp, err := http.Get(srv.URL + path); err != nil || resp.StatusCode != code {
+			t.Errorf("%s: expected %d, got %v %v", path, code, resp.StatusCode, err)
+		}
+	}
+
+	// With two days in memory, it was missing for 56% of them.
+	c := *conf()
+	c.MaxAge = duration{48 * time.Hour}
+	current.Store(&c)
+	if page := renderPage(FridgeConfig{Name: fridge, Template: "Lunarville.tmpl"}, fridge); !strings.Contains(page, "bbl.pop( 6 )") {
+		t.Errorf("bubbles not popped for the gaps: %s", page)
+	}
+	// A new fridge is only missing for its gaps since it started, as on /uptime.
+	fresh := "Uptimeville-new"
+	tapReport[fresh] = (*ICBMreport)(nil).Append(ICBMreport{FridgeName: fresh, StableSamples: ss})
+	if page := renderPage(FridgeConfig{Name: fresh, Template: "Lunarville.tmpl"}, fresh); !strings.Contains(page, "bbl.pop( 1 )") {
+		t.Errorf("bubbles popped for before a new fridge reported: %s", page)
+	}
+}
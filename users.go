@@ -0,0 +1,134 @@
+package main
+
+// The users subcommand. The user database lives in the ICBMUserDb environment
+// variable (or .env), so edits are printed as a new database to store there.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+var usersUsage = `
+Usage:
+	icbm users list
+	icbm users add <username>
+	icbm users enable <username>
+	icbm users disable <username>
+	icbm users remove <username>
+	icbm users admin <username>
+	icbm users noadmin <username>
+
+Lists or edits the API user database in ICBMUserDb. Edits print the updated
+database as JSON on standard output, ready to be stored back, eg:
+
+	fly secrets set ICBMUserDb="$(icbm users add fridge2)"
+
+`
+
+// usersCmd implements `icbm users`.
+func usersCmd(args []string) int {
+	fl := flag.NewFlagSet("users", flag.ExitOnError)
+	fl.Usage = func() { fmt.Fprint(os.Stderr, usersUsage) }
+	fl.Parse(args)
+
+	sub, name := fl.Arg(0), fl.Arg(1)
+	if sub == "list" && fl.NArg() == 1 {
+		listUsers(os.Stdout, userDB())
+		return 0
+	}
+	if fl.NArg() != 2 {
+		fl.Usage()
+		return 2
+	}
+	switch sub {
+	case "add":
+		key, err := addUser(userDB(), name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "icbm users:", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "added %s with API key %s\n", name, key)
+	case "enable", "disable", "remove", "admin", "noadmin":
+		if err := editUser(userDB(), name, sub); err != nil {
+			fmt.Fprintln(os.Stderr, "icbm users:", err)
+			return 1
+		}
+	default:
+		fl.Usage()
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.Encode(userDB())
+	return 0
+}
+
+// listUsers prints the users sorted by name, with their keys abbreviated.
+func listUsers(w io.Writer, db map[string]User) {
+	keys := make([]string, 0, len(db))
+	for k := range db {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return db[keys[i]].Username < db[keys[j]].Username })
+	for _, k := range keys {
+		state := "enabled"
+		if !db[k].Valid {
+			state = "disabled"
+		}
+		abbrev := k
+		if len(abbrev) > 8 {
+			abbrev = abbrev[:8] + "..."
+		}
+		fmt.Fprintf(w, "%-20s %-9s %s\n", db[k].Username, state, abbrev)
+	}
+}
+
+// addUser creates a new, enabled user with a random API key and returns the key.
+func addUser(db map[string]User, name string) (string, error) {
+	for _, u := range db {
+		if u.Username == name {
+			return "", fmt.Errorf("user %s already exists", name)
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+	db[key] = User{Username: name, Valid: true}
+	return key, nil
+}
+
+// editUser enables, disables, removes, or grants or revokes admin rights for
+// every key belonging to name.
+func editUser(db map[string]User, name, action string) error {
+	found := false
+	for k, u := range db {
+		if u.Username != name {
+			continue
+		}
+		found = true
+		switch action {
+		case "enable":
+			u.Valid = true
+			db[k] = u
+		case "disable":
+			u.Valid = false
+			db[k] = u
+		case "remove":
+			delete(db, k)
+		case "admin", "noadmin":
+			u.Admin = action == "admin"
+			db[k] = u
+		}
+	}
+	if !found {
+		return fmt.Errorf("no such user %s", name)
+	}
+	return nil
+}